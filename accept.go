@@ -0,0 +1,82 @@
+package apidiff
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AcceptFunc decides whether changed target interaction replaces the
+// recorded one
+type AcceptFunc func(interaction RequestInteraction, difference Differences) bool
+
+// AcceptSelected returns AcceptFunc accepting interactions selected by
+// "all", index shown by comparison, name, id or fingerprint
+func AcceptSelected(selectors ...string) AcceptFunc {
+	selected := make(map[string]bool, len(selectors))
+	for _, selector := range selectors {
+		selected[strings.TrimSpace(selector)] = true
+	}
+
+	return func(interaction RequestInteraction, difference Differences) bool {
+		return selected["all"] ||
+			selected[strconv.Itoa(difference.InteractionIndex)] ||
+			(interaction.Name != "" && selected[interaction.Name]) ||
+			(interaction.ID != "" && selected[interaction.ID]) ||
+			selected[interaction.Fingerprint()]
+	}
+}
+
+// Accept compares session against target manifest and promotes changed
+// target interactions approved by accept into a new version of session,
+// unchanged interactions are carried over so previous version is kept
+// in history. It returns the new version and indexes of accepted
+// interactions, no version is created when nothing was accepted.
+func (ad *APIDiff) Accept(source RecordedSession, target Manifest, accept AcceptFunc) (int, []int, error) {
+	if err := target.configure(); err != nil {
+		return 0, nil, err
+	}
+
+	targetStorage := NewMemoryStorage()
+	results, matched, err := ad.compare(source, target, targetStorage)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var accepted []int
+	for i, interaction := range target.Interactions {
+		if !ad.inScope(source, interaction) {
+			continue
+		}
+
+		difference, found := results[i]
+		if !found {
+			// interaction was not recorded in source session
+			difference = Differences{
+				URL:              interaction.URL,
+				InteractionIndex: i,
+				Headers:          map[string]error{},
+				Body: map[string]error{
+					"interaction": fmt.Errorf("missing in session %q", source.Name),
+				},
+				Changed: true,
+			}
+		}
+		if difference.Changed && accept(interaction, difference) {
+			accepted = append(accepted, i)
+		}
+	}
+	if len(accepted) == 0 {
+		return source.Version, nil, nil
+	}
+
+	version, err := ad.promote(source, target, accepted, targetStorage, matched)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if ad.Options.Verbose {
+		fmt.Printf("Accepted %d interactions into version %d of session %q...\n", len(accepted), version, source.Name)
+	}
+	return version, accepted, nil
+}
@@ -5,11 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
-	"path"
 	"path/filepath"
 	"reflect"
 	"strings"
@@ -20,7 +17,6 @@ import (
 	"github.com/tcnksm/go-httpstat"
 	"github.com/yudai/gojsondiff"
 	"github.com/yudai/gojsondiff/formatter"
-	"gopkg.in/yaml.v2"
 )
 
 var formatterConfig = formatter.AsciiFormatterConfig{
@@ -32,175 +28,271 @@ var formatterConfig = formatter.AsciiFormatterConfig{
 type APIDiff struct {
 	DirectoryPath string
 	Options       Options
+	Storage       Storage
 }
 
-// New creates a new instance
+// New creates a new instance storing sessions in directory or in
+// single archive when path ends with .tar.gz
 func New(path string, options Options) *APIDiff {
+	var storage Storage = NewFileStorage(path)
+	if IsArchivePath(path) {
+		storage = NewArchiveStorage(path)
+	}
+	return NewWithStorage(path, storage, options)
+}
+
+// NewWithStorage creates a new instance using given session storage
+func NewWithStorage(path string, storage Storage, options Options) *APIDiff {
 	return &APIDiff{
 		DirectoryPath: path,
 		Options:       options,
+		Storage:       storage,
 	}
 }
 
 // List existing stored API recording sessions
 func (ad *APIDiff) List() ([]RecordedSession, error) {
-	sessions := []RecordedSession{}
-	files, err := ioutil.ReadDir(ad.DirectoryPath)
+	sessions, err := ad.Storage.Sessions()
 	if err != nil {
-		return sessions, err
+		return []RecordedSession{}, err
 	}
 
-	for _, file := range files {
-		if file.IsDir() {
-			session := RecordedSession{
-				Name:    file.Name(),
-				Path:    path.Join(ad.DirectoryPath, file.Name()),
-				Created: file.ModTime(),
-			}
-
-			// iterates over saved interactions
-			paths, err := ad.listInteractions(session.Path)
-			if err != nil {
-				return sessions, err
-			}
+	for i := range sessions {
+		metadata, err := ad.metadata(sessions[i].Name)
+		if err != nil {
+			return sessions, err
+		}
 
-			for _, p := range paths {
-				interaction, err := ad.loadInteraction(p)
-				if err != nil {
-					continue
-				}
-				session.Interactions = append(session.Interactions, interaction)
-			}
-			sessions = append(sessions, session)
+		sessions[i].Version = metadata.CurrentVersion()
+		if err = ad.loadInteractions(&sessions[i]); err != nil {
+			return sessions, err
 		}
 	}
 
 	return sessions, nil
 }
 
-// Show returns an existing recorded session otherwise an error
+// Show returns current version of an existing recorded session
+// otherwise an error
 func (ad *APIDiff) Show(name string) (RecordedSession, error) {
-	session := RecordedSession{}
+	metadata, err := ad.metadata(name)
+	if err != nil {
+		return RecordedSession{}, err
+	}
+	if len(metadata.Versions) == 0 {
+		return RecordedSession{}, fmt.Errorf("Unable to find session %q", name)
+	}
+
+	return ad.ShowVersion(name, metadata.CurrentVersion())
+}
 
-	files, err := ioutil.ReadDir(ad.DirectoryPath)
+// Detail returns final exchange of interaction from recorded session
+// given its name and index
+func (ad *APIDiff) Detail(name string, interactionIndex int) (*cassette.Interaction, *RequestStats, error) {
+	key, err := ad.currentKey(name)
 	if err != nil {
-		return session, err
+		return nil, nil, err
 	}
 
-	var found = false
-	for _, file := range files {
-		if file.IsDir() && name == file.Name() {
-			sessionPath := path.Join(ad.DirectoryPath, name)
-			session = RecordedSession{
-				Name:    file.Name(),
-				Path:    sessionPath,
-				Created: file.ModTime(),
-			}
+	fingerprints, err := ad.Storage.Interactions(key)
+	if err != nil {
+		return nil, nil, err
+	}
 
-			paths, err := ad.listInteractions(sessionPath)
-			if err != nil {
-				return session, err
-			}
+	if interactionIndex < 1 || interactionIndex > len(fingerprints) {
+		return nil, nil, fmt.Errorf("unable to find interaction with index %d", interactionIndex)
+	}
 
-			// iterates over saved interactions
-			for _, p := range paths {
-				interaction, err := ad.loadInteraction(p)
-				if err != nil {
-					continue
-				}
-				session.Interactions = append(session.Interactions, interaction)
-			}
-			found = true
-			break
-		}
+	stored, err := ad.Storage.LoadInteraction(key, fingerprints[interactionIndex-1])
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if !found {
-		return session, fmt.Errorf("Unable to find session %q", name)
+	stats := stored.Stats
+	if stats == nil {
+		stats = &RequestStats{}
 	}
+	return stored.Final(), stats, nil
+}
 
-	return session, nil
+// Record stores requested URL using casettes into a defined directory,
+// interaction is added to the latest version of session
+func (ad *APIDiff) Record(dir, name string, interaction RequestInteraction, ri RequestInfo, rules []MatchingRules) error {
+	target := ad
+	if storage := ad.storageAt(dir); storage != ad.Storage {
+		target = NewWithStorage(dir, storage, ad.Options)
+	}
+
+	key, err := target.recordingKey(name)
+	if err != nil {
+		return err
+	}
+	return target.record(target.Storage, key, interaction, ri, rules)
 }
 
-// Detail returns interaction from recorded session given
-// its name and index
-func (ad *APIDiff) Detail(name string, interactionIndex int) (*cassette.Interaction, *RequestStats, error) {
-	sessionPath := path.Join(ad.DirectoryPath, name)
-	paths, err := ad.listInteractions(sessionPath)
+// RecordVersion records all manifest interactions as a new version of
+// session
+func (ad *APIDiff) RecordVersion(name string, manifest Manifest) (int, error) {
+	if err := manifest.configure(); err != nil {
+		return 0, err
+	}
+
+	version, err := ad.NewVersion(name)
 	if err != nil {
-		return nil, nil, err
+		return 0, err
 	}
 
-	var result *cassette.Interaction
-	var stats RequestStats
-	found := false
-	i := 0
-	for _, path := range paths {
-		if i == interactionIndex-1 {
-			// parse interactions
-			result, err = ad.loadCassette(path)
-			if err != nil {
-				return nil, nil, err
-			}
+	ri := manifest.session()
+	tags := make(map[string][]string)
+	for _, interaction := range manifest.Interactions {
+		if !ad.Options.Selection.Match(interaction.Tags) {
+			continue
+		}
 
-			// parse interaction stats
-			stats, err = ad.loadRequestStats(path)
-			if err != nil {
-				return nil, nil, err
-			}
-			found = true
-			break
+		err = ad.record(ad.Storage, versionKey(name, version), interaction, ri, manifest.MatchingRules)
+		if err != nil {
+			return version, err
+		}
+		if len(interaction.Tags) > 0 {
+			tags[interaction.Fingerprint()] = interaction.Tags
 		}
-		i++
 	}
 
-	if !found {
-		return nil, nil, fmt.Errorf("unable to find interaction with index %d", interactionIndex)
+	return version, ad.updateVersion(name, version, func(v *SessionVersion) {
+		v.Selection = ad.Options.Selection.copy()
+		v.Tags = tags
+	})
+}
+
+// Rerecord records manifest interactions matching filter again and
+// stores them together with untouched interactions of session baseline
+// as a new version of session. The version is created only when all
+// selected interactions were recorded, it returns the new version and
+// indexes of recorded interactions. Interactions setting cookies are
+// sent again when manifest shares cookies.
+func (ad *APIDiff) Rerecord(name string, manifest Manifest, filter InteractionFilter) (int, []int, error) {
+	if err := manifest.configure(); err != nil {
+		return 0, nil, err
+	}
+
+	var selected []int
+	for _, i := range manifest.Select(filter) {
+		if ad.Options.Selection.Match(manifest.Interactions[i].Tags) {
+			selected = append(selected, i)
+		}
+	}
+	if len(selected) == 0 {
+		return 0, nil, errors.New("no manifest interaction matches filter")
 	}
 
-	return result, &stats, nil
+	metadata, err := ad.metadata(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(metadata.Versions) == 0 {
+		return 0, nil, fmt.Errorf("Unable to find session %q", name)
+	}
+	source := RecordedSession{Name: name, Version: metadata.CurrentVersion()}
+
+	// interactions are recorded aside so session is never left partially
+	// updated
+	recorded := NewMemoryStorage()
+	sourceKey := versionKey(name, source.Version)
+	ri := manifest.session()
+	// cookies set after last selected interaction are never used
+	last := selected[len(selected)-1]
+	for i, interaction := range manifest.Interactions[:last+1] {
+		switch {
+		case containsInt(selected, i):
+			err = ad.record(recorded, name, interaction, ri, manifest.MatchingRules)
+		case ad.setsCookies(sourceKey, ri, interaction):
+			err = ad.record(NewMemoryStorage(), name, interaction, ri, manifest.MatchingRules)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	version, err := ad.promote(source, manifest, selected, recorded, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	return version, selected, nil
 }
 
-// Record stores requested URL using casettes into a defined directory
-func (ad *APIDiff) Record(dir, name string, interaction RequestInteraction, ri RequestInfo, rules []MatchingRules) error {
+func (ad *APIDiff) record(storage Storage, name string, interaction RequestInteraction, ri RequestInfo, rules []MatchingRules) error {
 	url := interaction.URL
 	method := strings.ToUpper(interaction.Method)
-	path := path.Join(ad.getPath(dir, name), interaction.Fingerprint())
+	fingerprint := interaction.Fingerprint()
+	rules = mergeRules(rules, interaction.MatchingRules)
 
 	if ad.Options.Verbose {
-		fmt.Printf("Recording %s %q into \"%s.yaml\"...\n", method, url, path)
+		fmt.Printf("Recording %s %q into %q of session %q...\n", method, url, fingerprint, name)
 	}
 
-	r, err := ad.createRecorder(path, rules)
+	compiled, err := compileRules(rules)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err = r.Stop(); err != nil {
-			panic(err)
+	if ri.auth != nil {
+		redaction, err := ri.auth.redactionRule()
+		if err != nil {
+			return err
 		}
-	}()
+		compiled = append(compiled, redaction)
+	}
 
-	// create request from manifest defintion
-	var payload io.Reader
-	if ri.Payload != "" {
-		payload = strings.NewReader(ri.Payload)
+	r, err := ad.createRecorder(compiled)
+	if err != nil {
+		return err
 	}
 
-	// send interaction specific payload
-	if interaction.Payload != "" {
-		payload = strings.NewReader(interaction.Payload)
+	// recorded exchanges are kept in memory and saved into storage
+	var recorded []*cassette.Interaction
+	r.AddFilter(func(ci *cassette.Interaction) error {
+		recorded = append(recorded, ci)
+		return nil
+	})
+
+	// create request from manifest defintion, interaction specific
+	// payload replaces the shared one except JSON documents that are
+	// deep merged
+	var payload io.Reader
+	body, contentType, err := requestBody(interaction, ri)
+	if err != nil {
+		return err
+	}
+	if body != "" {
+		payload = strings.NewReader(body)
 	}
 
-	req, err := http.NewRequest(method, url, payload)
+	req, err := http.NewRequest(method, interaction.requestURL(), payload)
 	if err != nil {
 		return err
 	}
 
-	//TODO: apply common and interaction specific HTTP headers
+	// interaction specific HTTP headers replace the common ones
 	for headerKey, headerValue := range ri.Headers {
 		for _, childHeaderValue := range headerValue {
-			req.Header.Set(headerKey, childHeaderValue)
+			req.Header.Add(headerKey, childHeaderValue)
+		}
+	}
+	for headerKey, headerValue := range interaction.Headers {
+		req.Header.Del(headerKey)
+		for _, childHeaderValue := range headerValue {
+			req.Header.Add(headerKey, childHeaderValue)
+		}
+	}
+
+	// form bodies define their own content type, types of other bodies
+	// are used only when it is not set
+	if contentType != "" && (interaction.Form != nil || interaction.Multipart != nil || req.Header.Get("Content-Type") == "") {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if ri.auth != nil {
+		if err = ri.auth.authenticate(req); err != nil {
+			return err
 		}
 	}
 
@@ -210,8 +302,14 @@ func (ad *APIDiff) Record(dir, name string, interaction RequestInteraction, ri R
 	req = req.WithContext(ctx)
 
 	// Create an HTTP client and inject our recorder
+	redirects := ri.redirects
+	if interaction.Redirects != nil {
+		redirects = interaction.Redirects
+	}
 	client := &http.Client{
-		Transport: r,
+		Transport:     r,
+		Jar:           ri.jar,
+		CheckRedirect: redirects.checkRedirect,
 	}
 
 	resp, err := client.Do(req)
@@ -225,9 +323,24 @@ func (ad *APIDiff) Record(dir, name string, interaction RequestInteraction, ri R
 		}
 	}()
 
-	err = ad.writeRequestStats(path, stats)
+	// secrets are redacted only in stored copies
+	storageFilter := ad.createStorageFilter(compiled)
+	stored := make([]*cassette.Interaction, len(recorded))
+	for i, ci := range recorded {
+		stored[i] = copyInteraction(ci)
+		if err = storageFilter(stored[i]); err != nil {
+			return err
+		}
+	}
+
+	requestStats := newRequestStats(stats)
+	err = storage.SaveInteraction(name, fingerprint, &StoredInteraction{
+		Interactions: stored,
+		Stats:        &requestStats,
+		Recorded:     time.Now(),
+	})
 	if err != nil {
-		return fmt.Errorf("Unable to write request stats - %s", err)
+		return fmt.Errorf("Unable to store interaction - %s", err)
 	}
 
 	if ad.Options.Verbose {
@@ -240,134 +353,261 @@ func (ad *APIDiff) Record(dir, name string, interaction RequestInteraction, ri R
 
 // Compare compare stored session against a manifest
 func (ad *APIDiff) Compare(source RecordedSession, target Manifest) (map[int]Differences, error) {
+	// target is recorded only for the time of comparison
+	results, _, err := ad.compare(source, target, NewMemoryStorage())
+	return results, err
+}
+
+// compare records target manifest into session of target storage and
+// compares it against stored session, it returns differences and
+// fingerprints of recorded interactions paired by request matchers
+func (ad *APIDiff) compare(source RecordedSession, target Manifest, targetStorage Storage) (map[int]Differences, map[int]string, error) {
 	var results = make(map[int]Differences)
+	matched := make(map[int]string)
 	rules := target.MatchingRules
 
-	// create temp location for target cassettes
-	tcDir, err := ioutil.TempDir("/tmp", "apidifftest")
-	if err != nil {
-		return results, err
+	if err := target.configure(); err != nil {
+		return results, matched, err
 	}
 
-	scPath := ad.getPath(ad.DirectoryPath, source.Name)
+	sourceKey := versionKey(source.Name, source.Version)
+	fingerprints, err := ad.Storage.Interactions(sourceKey)
+	if err != nil {
+		return results, matched, err
+	}
+	recorded := make(map[string]bool, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		recorded[fingerprint] = true
+	}
 
+	// recorded interactions of target fingerprints are not paired by
+	// request matchers
+	claimed := make(map[string]bool)
+	last := -1
 	for i, interaction := range target.Interactions {
-		// record target into temporary location
-		err = ad.Record(
-			tcDir,
+		if ad.inScope(source, interaction) {
+			claimed[ad.storedFingerprint(sourceKey, interaction)] = true
+			last = i
+		}
+	}
+
+	// target gets its own cookie jar filled by the same interactions
+	ri := target.session()
+	var requests map[string]cassette.Request
+
+	// cookies set after last interaction in scope are never used
+	for i, interaction := range target.Interactions[:last+1] {
+		if !ad.inScope(source, interaction) {
+			if ad.setsCookies(sourceKey, ri, interaction) {
+				err = ad.record(NewMemoryStorage(), source.Name, interaction, ri, rules)
+				if err != nil {
+					return results, matched, err
+				}
+			}
+			continue
+		}
+		interactionRules := mergeRules(rules, interaction.MatchingRules)
+
+		err := ad.record(
+			targetStorage,
 			source.Name,
 			interaction,
-			target.Request,
+			ri,
 			rules,
 		)
 		if err != nil {
-			return results, err
+			return results, matched, err
 		}
 
-		// wait for cassette until it is store in FS
-		targetCassettePath := path.Join(
-			tcDir,
-			source.Name,
-			interaction.Fingerprint(),
-		)
-		if err = ad.waitForFile(fmt.Sprintf("%s.yaml", targetCassettePath), 0); err != nil {
-			return results, err
-		}
-
-		// load target cassette
-		tc, err := cassette.Load(targetCassettePath)
+		tc, err := targetStorage.LoadInteraction(source.Name, interaction.Fingerprint())
 		if err != nil {
-			return results, err
+			return results, matched, err
 		}
 
-		// load source cassette
-		if len(source.Interactions) > i {
-			sc, err := cassette.Load(
-				path.Join(scPath, interaction.Fingerprint()),
-			)
+		// only interactions recorded in source session are compared,
+		// request matchers pair interactions whose fingerprints changed
+		fingerprint := ad.storedFingerprint(sourceKey, interaction)
+		if recorded[fingerprint] {
+			claimed[fingerprint] = true
+		} else {
+			compiled, err := compileRules(interactionRules)
 			if err != nil {
-				return results, err
+				return results, matched, err
+			}
+			matcher := ad.requestMatcher(compiled)
+			if matcher == nil {
+				continue
 			}
 
-			// do comparison and collect errors
-			result, err := ad.compareInteractions(
-				i,
-				rules,
-				*sc.Interactions[0],
-				*tc.Interactions[0],
-			)
+			// recorded requests are loaded once for all interactions
+			if requests == nil {
+				if requests, err = ad.storedRequests(sourceKey, fingerprints); err != nil {
+					return results, matched, err
+				}
+			}
+			fingerprint, err = matchedFingerprint(matcher, fingerprints, requests, tc, claimed)
 			if err != nil {
-				return results, err
+				return results, matched, err
+			}
+			if fingerprint == "" {
+				continue
 			}
-			results[i] = result
+			claimed[fingerprint] = true
+			matched[i] = fingerprint
+		}
+
+		sc, err := ad.Storage.LoadInteraction(sourceKey, fingerprint)
+		if err != nil {
+			return results, matched, err
 		}
-	}
 
-	// finally cleanup all temporary resources
-	if err = os.RemoveAll(tcDir); err != nil {
-		return results, nil
+		// do comparison and collect errors
+		result, err := ad.compareStored(
+			i,
+			interactionRules,
+			sc,
+			tc,
+		)
+		if err != nil {
+			return results, matched, err
+		}
+		result.URL = interaction.URL
+		results[i] = result
 	}
 
-	return results, nil
+	return results, matched, nil
 }
 
-// Delete an existing recorded session; otherwise returns error
-func (ad *APIDiff) Delete(name string) error {
-	path := ad.getPath(ad.DirectoryPath, name)
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return err
-	}
+// matchedFingerprint returns fingerprint of unclaimed recorded request
+// that target interaction matches, empty fingerprint is returned when no
+// recorded request matches
+func matchedFingerprint(matcher cassette.Matcher, fingerprints []string, requests map[string]cassette.Request, target *StoredInteraction, claimed map[string]bool) (string, error) {
+	tr := target.Interaction().Request
+	for _, fingerprint := range fingerprints {
+		if claimed[fingerprint] {
+			continue
+		}
 
-	if ad.Options.Verbose {
-		fmt.Printf("Recorded session %q was removed...\n", name)
+		req, err := http.NewRequest(tr.Method, tr.URL, strings.NewReader(tr.Body))
+		if err != nil {
+			return "", err
+		}
+		req.Header = copyHeader(tr.Headers)
+		if matcher(req, requests[fingerprint]) {
+			return fingerprint, nil
+		}
 	}
-
-	return os.RemoveAll(path)
+	return "", nil
 }
 
-func (ad *APIDiff) writeRequestStats(path string, result httpstat.Result) error {
-	dirpath := filepath.Dir(path)
-	if _, err := os.Stat(dirpath); os.IsNotExist(err) {
-		if err := os.MkdirAll(dirpath, os.ModePerm); err != nil {
-			return err
+// storedRequests returns first requests of stored interactions by their
+// fingerprints
+func (ad *APIDiff) storedRequests(key string, fingerprints []string) (map[string]cassette.Request, error) {
+	requests := make(map[string]cassette.Request, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		stored, err := ad.Storage.LoadInteraction(key, fingerprint)
+		if err != nil {
+			return nil, err
 		}
+		requests[fingerprint] = stored.Interaction().Request
+	}
+	return requests, nil
+}
+
+// setsCookies reports whether interaction left out of a run has to be
+// replayed without being stored, so that cookies it set when session was
+// recorded reach interactions of the run
+func (ad *APIDiff) setsCookies(key string, ri RequestInfo, interaction RequestInteraction) bool {
+	if ri.jar == nil {
+		return false
 	}
 
-	filepath := fmt.Sprintf("%s_stats.yaml", path)
-	file, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE, 0600)
+	stored, err := ad.Storage.LoadInteraction(key, ad.storedFingerprint(key, interaction))
 	if err != nil {
-		return err
+		return false
 	}
-	defer func() {
-		if err = file.Close(); err != nil {
-			panic(err)
+	for _, ci := range stored.Interactions {
+		if ci.Response.Headers.Get("Set-Cookie") != "" {
+			return true
 		}
-	}()
+	}
+	return false
+}
 
-	stats := RequestStats{
-		DNSLookup:        int(result.DNSLookup / time.Millisecond),
-		TCPConnection:    int(result.TCPConnection / time.Millisecond),
-		TLSHandshake:     int(result.TLSHandshake / time.Millisecond),
-		ServerProcessing: int(result.ServerProcessing / time.Millisecond),
-		ContentTransfer:  int(result.ContentTransfer(time.Now()) / time.Millisecond),
+// inScope reports whether interaction is selected by options and was
+// part of selection session was recorded with
+func (ad *APIDiff) inScope(source RecordedSession, interaction RequestInteraction) bool {
+	if !ad.Options.Selection.Match(interaction.Tags) {
+		return false
 	}
+	return source.Selection == nil || source.Selection.Match(interaction.Tags)
+}
 
-	output, err := yaml.Marshal(&stats)
+// Migrate renames interactions of a session recorded with legacy or
+// default fingerprints to the scheme configured by manifest
+func (ad *APIDiff) Migrate(name string, manifest Manifest) (int, error) {
+	key, err := ad.currentKey(name)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if err := manifest.configure(); err != nil {
+		return 0, err
 	}
 
-	_, err = file.Write(output)
-	if err != nil {
+	migrated := 0
+	for _, interaction := range manifest.Interactions {
+		current := interaction.Fingerprint()
+		previous := ad.storedFingerprint(key, interaction)
+		if previous == current {
+			continue
+		}
+
+		stored, err := ad.Storage.LoadInteraction(key, previous)
+		if err != nil {
+			return migrated, err
+		}
+		if err = ad.Storage.SaveInteraction(key, current, stored); err != nil {
+			return migrated, err
+		}
+		if err = ad.Storage.DeleteInteraction(key, previous); err != nil {
+			return migrated, err
+		}
+
+		if ad.Options.Verbose {
+			fmt.Printf("Migrated %q into %q...\n", previous, current)
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// Delete an existing recorded session; otherwise returns error
+func (ad *APIDiff) Delete(name string) error {
+	if err := ad.Storage.DeleteSession(name); err != nil {
 		return err
 	}
 
 	if ad.Options.Verbose {
-		fmt.Printf("Writing request metrics into %q...\n", filepath)
+		fmt.Printf("Recorded session %q was removed...\n", name)
 	}
+
 	return nil
 }
 
+// compareStored compares final responses and redirect chains leading to
+// them
+func (ad *APIDiff) compareStored(idx int, rules []MatchingRules, source, target *StoredInteraction) (Differences, error) {
+	result, err := ad.compareInteractions(idx, rules, *source.Final(), *target.Final())
+	if err != nil {
+		return result, err
+	}
+
+	result.Redirects = compareRedirects(source.Interactions, target.Interactions)
+	result.Changed = result.Changed || len(result.Redirects) > 0
+	return result, nil
+}
+
 func (ad *APIDiff) compareInteractions(idx int, rules []MatchingRules, source cassette.Interaction, target cassette.Interaction) (Differences, error) {
 	result := Differences{
 		InteractionIndex: idx,
@@ -379,24 +619,13 @@ func (ad *APIDiff) compareInteractions(idx int, rules []MatchingRules, source ca
 	sr := source.Response
 	tr := target.Response
 
-	// header ignore rules
-	ignoreHeaders := make(map[string]bool)
-	for _, rule := range rules {
-		if rule.Name == "ignore_headers" {
-			for _, headerKey := range rule.Value.([]interface{}) {
-				ignoreHeaders[headerKey.(string)] = true
-			}
-			break
-		}
+	compiled, err := compileRules(rules)
+	if err != nil {
+		return result, err
 	}
 
 	// compare headers
 	for sk, sv := range sr.Headers {
-		// skip excluded headers
-		if _, found := ignoreHeaders[sk]; found {
-			continue
-		}
-
 		tv, found := tr.Headers[sk]
 		if !found {
 			result.Headers[sk] = errors.New("header is missing")
@@ -408,67 +637,116 @@ func (ad *APIDiff) compareInteractions(idx int, rules []MatchingRules, source ca
 		}
 	}
 
-	// compare body using JSON diff
-	jd := gojsondiff.New()
-	diff, err := jd.Compare([]byte(sr.Body), []byte(tr.Body))
-	if err != nil {
-		return result, err
-	}
-
-	if diff.Modified() {
-		// get source JSON for showing difference
-		var diffJSON map[string]interface{}
-		err := json.Unmarshal([]byte(sr.Body), &diffJSON)
+	// compare body using JSON diff, other bodies such as those of
+	// redirects are compared as text
+	var sourceJSON, targetJSON map[string]interface{}
+	if json.Unmarshal([]byte(sr.Body), &sourceJSON) != nil || json.Unmarshal([]byte(tr.Body), &targetJSON) != nil {
+		if sr.Body != tr.Body {
+			result.Body["payload"] = fmt.Errorf("expect %q but got %q", sr.Body, tr.Body)
+		}
+	} else {
+		jd := gojsondiff.New()
+		diff, err := jd.Compare([]byte(sr.Body), []byte(tr.Body))
 		if err != nil {
 			return result, err
 		}
 
-		formatter := formatter.NewAsciiFormatter(diffJSON, formatterConfig)
-		diffString, err := formatter.Format(diff)
-		if err != nil {
-			return result, err
+		if diff.Modified() {
+			// source JSON is used for showing difference
+			formatter := formatter.NewAsciiFormatter(sourceJSON, formatterConfig)
+			diffString, err := formatter.Format(diff)
+			if err != nil {
+				return result, err
+			}
+			result.Body["payload"] = fmt.Errorf("%s", diffString)
 		}
-		result.Body["payload"] = fmt.Errorf("%s", diffString)
-		result.Changed = true
 	}
 
+	// rules remove expected differences
+	for _, rule := range compiled {
+		if filter, ok := rule.(ComparisonFilter); ok {
+			filter.FilterDifferences(&source, &target, &result)
+		}
+	}
+	result.Changed = len(result.Headers) > 0 || len(result.Body) > 0
+
 	return result, nil
 }
 
-func (ad *APIDiff) createRecorder(path string, rules []MatchingRules) (*recorder.Recorder, error) {
-	r, err := recorder.New(path)
+func (ad *APIDiff) createRecorder(rules []Rule) (*recorder.Recorder, error) {
+	// cassette is never saved by recorder itself, recording always hits
+	// live API so request matchers of rules are not used here
+	r, err := recorder.NewAsMode("", recorder.ModeRecording, nil)
 	if err != nil {
 		return r, err
 	}
 
-	// custom request matcher based on specified rules
-	r.SetMatcher(func(r *http.Request, cr cassette.Request) bool {
-		if len(rules) > 0 {
-			for _, rule := range rules {
-				if rule.Name == "match_url" {
-					return rule.Value.(bool)
-				}
+	// custom filter for stored request data
+	r.AddFilter(ad.createFilter(rules))
+
+	return r, err
+}
+
+// requestMatcher returns matcher of rules, nil is returned when rules
+// have no request matcher
+func (ad *APIDiff) requestMatcher(rules []Rule) cassette.Matcher {
+	for _, rule := range rules {
+		if _, ok := rule.(RequestMatcher); ok {
+			return ad.createMatcher(rules)
+		}
+	}
+	return nil
+}
+
+func (ad *APIDiff) createMatcher(rules []Rule) cassette.Matcher {
+	return func(r *http.Request, cr cassette.Request) bool {
+		for _, rule := range rules {
+			if matcher, ok := rule.(RequestMatcher); ok {
+				return matcher.MatchRequest(r, cr)
 			}
 		}
 
 		return cassette.DefaultMatcher(r, cr)
-	})
+	}
+}
 
-	// custom filter for stored request data
-	r.AddFilter(func(ci *cassette.Interaction) error {
-		if len(rules) > 0 {
-			for _, rule := range rules {
-				if rule.Name == "ignore_headers" {
-					for _, headerKey := range rule.Value.([]interface{}) {
-						delete(ci.Request.Headers, headerKey.(string))
-					}
+func (ad *APIDiff) createFilter(rules []Rule) cassette.Filter {
+	return func(ci *cassette.Interaction) error {
+		for _, rule := range rules {
+			if filter, ok := rule.(RecordingFilter); ok {
+				if err := filter.FilterRecording(ci); err != nil {
+					return err
 				}
 			}
 		}
 		return nil
-	})
+	}
+}
 
-	return r, err
+// createStorageFilter applies storage filters of rules, default
+// redaction is used unless rules configure their own
+func (ad *APIDiff) createStorageFilter(rules []Rule) cassette.Filter {
+	var filters []StorageFilter
+	redacted := false
+	for _, rule := range rules {
+		if filter, ok := rule.(StorageFilter); ok {
+			filters = append(filters, filter)
+		}
+		redacted = redacted || rule.Name() == "redact"
+	}
+	if !redacted {
+		redaction, _ := compileRedaction(DefaultRedaction())
+		filters = append(filters, redaction)
+	}
+
+	return func(ci *cassette.Interaction) error {
+		for _, filter := range filters {
+			if err := filter.FilterStorage(ci); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 }
 
 func (ad *APIDiff) isValidURL(strURL string) bool {
@@ -479,83 +757,93 @@ func (ad *APIDiff) isValidURL(strURL string) bool {
 	return true
 }
 
-func (ad *APIDiff) listInteractions(basePath string) ([]string, error) {
-	paths := []string{}
+// loadInteractions fills session with summaries of stored interactions
+func (ad *APIDiff) loadInteractions(session *RecordedSession) error {
+	metadata, err := ad.metadata(session.Name)
+	if err != nil {
+		return err
+	}
+	version := metadata.version(session.Version)
+	session.Selection = version.Selection
 
-	files, err := ioutil.ReadDir(basePath)
+	key := versionKey(session.Name, session.Version)
+	fingerprints, err := ad.Storage.Interactions(key)
 	if err != nil {
-		return paths, err
+		return err
 	}
 
-	for _, file := range files {
-		if !file.IsDir() && !strings.HasSuffix(file.Name(), "_stats.yaml") {
-			paths = append(paths, path.Join(basePath, file.Name()))
+	for _, fingerprint := range fingerprints {
+		stored, err := ad.Storage.LoadInteraction(key, fingerprint)
+		if err != nil {
+			continue
+		}
+		if isLegacyFingerprint(fingerprint) {
+			session.Legacy = true
+		}
+
+		// requested URL is shown with status of the final response
+		c := stored.Interaction()
+		interaction := RecordedInteraction{
+			URL:         c.Request.URL,
+			Method:      c.Request.Method,
+			StatusCode:  stored.Final().Response.Code,
+			Fingerprint: fingerprint,
+			Tags:        version.Tags[fingerprint],
+		}
+		if !ad.Options.Selection.Match(interaction.Tags) {
+			continue
+		}
+		if stored.Stats != nil {
+			interaction.Stats = *stored.Stats
 		}
+		session.Interactions = append(session.Interactions, interaction)
 	}
-	return paths, err
+	return nil
 }
 
-func (ad *APIDiff) loadInteraction(path string) (RecordedInteraction, error) {
-	interaction := RecordedInteraction{}
+// storedFingerprint returns fingerprint interaction is stored under in
+// session version falling back to previous fingerprints for sessions
+// that were not migrated yet
+func (ad *APIDiff) storedFingerprint(key string, interaction RequestInteraction) string {
+	current := interaction.Fingerprint()
 
-	// parse interactions
-	c, err := ad.loadCassette(path)
+	fingerprints, err := ad.Storage.Interactions(key)
 	if err != nil {
-		return interaction, err
+		return current
 	}
 
-	// parse interaction stats
-	stats, err := ad.loadRequestStats(path)
-	if err != nil {
-		return interaction, nil
+	stored := make(map[string]bool, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		stored[fingerprint] = true
 	}
-
-	interaction = RecordedInteraction{
-		URL:        c.Request.URL,
-		Method:     c.Request.Method,
-		StatusCode: c.Response.Code,
-		Stats:      stats,
+	if stored[current] {
+		return current
 	}
 
-	return interaction, nil
-}
-
-func (ad *APIDiff) loadCassette(path string) (*cassette.Interaction, error) {
-	c, err := cassette.Load(strings.Replace(path, ".yaml", "", 1))
-	if err != nil {
-		return nil, err
+	for _, fingerprint := range interaction.previousFingerprints() {
+		if stored[fingerprint] {
+			return fingerprint
+		}
 	}
-	return c.Interactions[0], nil
+	return current
 }
 
-func (ad *APIDiff) loadRequestStats(path string) (RequestStats, error) {
-	stats := RequestStats{}
-
-	path = strings.Replace(path, ".yaml", "_stats.yaml", -1)
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return stats, err
+// storageAt returns instance storage or directory storage for
+// recording outside of it
+func (ad *APIDiff) storageAt(dir string) Storage {
+	if dir == "" || dir == ad.DirectoryPath {
+		return ad.Storage
 	}
-
-	err = yaml.Unmarshal(data, &stats)
-	if err != nil {
-		return stats, err
+	if IsArchivePath(dir) {
+		return NewArchiveStorage(dir)
 	}
-
-	return stats, nil
+	return NewFileStorage(dir)
 }
 
-func (ad *APIDiff) waitForFile(path string, retry int) error {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		if retry <= 50 {
-			time.Sleep(100 * time.Millisecond)
-			return ad.waitForFile(path, retry+1)
-		}
-		return fmt.Errorf("unable to read file %q within time", path)
+// sessionPath returns location of session for display purposes
+func (ad *APIDiff) sessionPath(name string) string {
+	if fs, ok := ad.Storage.(*FileStorage); ok {
+		return filepath.Join(fs.Path, name)
 	}
-	return nil
-}
-
-func (ad *APIDiff) getPath(dir, name string) string {
-	return path.Join(dir, name)
+	return ad.DirectoryPath
 }
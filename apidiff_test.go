@@ -2,12 +2,21 @@ package apidiff
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/dnaeon/go-vcr/cassette"
 )
 
 const (
@@ -225,6 +234,259 @@ func TestManifestParsing(t *testing.T) {
 	}
 }
 
+func TestManifestIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apidifftest")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"common.yaml": `
+request:
+  headers:
+    Accept: ["application/json"]
+    X-Client: ["common"]
+matching_rules:
+  - name: ignore_headers
+    value: [Date]
+`,
+		"domains/users.yaml": `
+interactions:
+  - url: "http://localhost/users"
+    method: get
+`,
+		"domains/posts.yaml": `
+request:
+  headers:
+    X-Client: ["posts"]
+interactions:
+  - url: "http://localhost/posts"
+    method: get
+`,
+		"main.yaml": `
+version: 1
+include: [common.yaml, "domains/*.yaml"]
+matching_rules:
+  - name: ignore_headers
+    value: [Date, ETag]
+interactions:
+  - url: "http://localhost/users"
+    method: get
+`,
+		"cycle.yaml": `
+include: [cycle.yaml]
+`,
+	}
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			panic(err)
+		}
+		if err = ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			panic(err)
+		}
+	}
+
+	manifest := NewManifest()
+	if err = manifest.ParseFile(filepath.Join(dir, "main.yaml")); err != nil {
+		panic(err)
+	}
+
+	var urls []string
+	for _, interaction := range manifest.Interactions {
+		urls = append(urls, strings.TrimPrefix(interaction.URL, "http://localhost"))
+	}
+	if !reflect.DeepEqual(urls, []string{"/posts", "/users", "/users"}) {
+		t.Errorf("Expected included interactions followed by own ones but got %v", urls)
+	}
+	if len(manifest.MatchingRules) != 1 || len(manifest.MatchingRules[0].Value.([]interface{})) != 2 {
+		t.Errorf("Expected own matching rule to take precedence but got %+v", manifest.MatchingRules)
+	}
+	if manifest.Request.Headers.Get("X-Client") != "posts" || manifest.Request.Headers.Get("Accept") != "application/json" {
+		t.Errorf("Expected later request defaults to take precedence but got %v", manifest.Request.Headers)
+	}
+
+	duplicates := manifest.DuplicateFingerprints()
+	if len(duplicates) != 1 {
+		t.Errorf("Expected duplicate fingerprint across included files but got %v", duplicates)
+	}
+	for _, indexes := range duplicates {
+		origins := []string{
+			manifest.Interactions[indexes[0]].Origin(),
+			manifest.Interactions[indexes[1]].Origin(),
+		}
+		expected := []string{filepath.Join(dir, "domains/users.yaml"), filepath.Join(dir, "main.yaml")}
+		if !reflect.DeepEqual(origins, expected) {
+			t.Errorf("Expected duplicates to come from %v but got %v", expected, origins)
+		}
+	}
+
+	if err = NewManifest().ParseFile(filepath.Join(dir, "cycle.yaml")); err == nil {
+		t.Error("Expected manifest including itself to fail")
+	}
+}
+
+func TestManifestValidation(t *testing.T) {
+	invalid := map[string]string{
+		"unknown key":       "version: 1\ninteractions:\n  - url: http://localhost/\n    colour: red\n",
+		"version":           "version: 3\ninteractions: []\n",
+		"method":            "interactions:\n  - url: http://localhost/\n    method: fetch\n",
+		"ignore_headers":    "matching_rules:\n  - name: ignore_headers\n    value: Date\ninteractions: []\n",
+		"match_url":         "matching_rules:\n  - name: match_url\n    value: [yes]\ninteractions: []\n",
+		"match_url false":   "matching_rules:\n  - name: match_url\n    value: false\ninteractions: []\n",
+		"interaction id":    "interactions:\n  - id: \"no spaces\"\n    url: http://localhost/\n",
+		"duplicate mapping": "version: 1\nversion: 1\n",
+	}
+	for name, document := range invalid {
+		if err := NewManifest().Parse(strings.NewReader(document)); err == nil {
+			t.Errorf("Expected manifest with invalid %s to be rejected", name)
+		}
+	}
+
+	// malformed rules of manifests built in code are reported
+	ad := New("", Options{})
+	rules := []MatchingRules{{Name: "ignore_headers", Value: "Date"}}
+	interaction := cassette.Interaction{}
+	interaction.Response.Body = "{}"
+	if _, err := ad.compareInteractions(0, rules, interaction, interaction); err == nil {
+		t.Error("Expected malformed rule to be reported")
+	}
+}
+
+type ignoreStatusRule struct {
+	Statuses []int `yaml:"statuses"`
+}
+
+func (r ignoreStatusRule) Name() string {
+	return "ignore_status"
+}
+
+func (r ignoreStatusRule) FilterDifferences(source, target *cassette.Interaction, differences *Differences) {
+	for _, status := range r.Statuses {
+		if target.Response.Code == status {
+			differences.Headers = map[string]error{}
+			differences.Body = map[string]error{}
+		}
+	}
+}
+
+func TestRuleRegistry(t *testing.T) {
+	err := RegisterRule("ignore_status", func(value interface{}) (Rule, error) {
+		var rule ignoreStatusRule
+		err := DecodeRuleValue(value, &rule)
+		return rule, err
+	})
+	if err != nil {
+		panic(err)
+	}
+	if err = RegisterRule("ignore_headers", nil); err == nil {
+		t.Error("Expected registration of existing rule to fail")
+	}
+
+	manifest := NewManifest()
+	err = manifest.Parse(strings.NewReader(`
+matching_rules:
+  - name: ignore_status
+    value:
+      statuses: [503]
+  - name: ignore_headers
+    value: [Date]
+interactions: []
+`))
+	if err != nil {
+		panic(err)
+	}
+
+	source := cassette.Interaction{}
+	source.Response.Body = `{"status":"ok"}`
+	source.Response.Headers = http.Header{"Date": {"yesterday"}}
+	target := source
+	target.Response.Code = 503
+	target.Response.Body = `{"status":"maintenance"}`
+	target.Response.Headers = http.Header{"Date": {"today"}}
+
+	ad := New("", Options{})
+	differences, err := ad.compareInteractions(0, manifest.MatchingRules, source, target)
+	if err != nil {
+		panic(err)
+	}
+	if differences.Changed {
+		t.Errorf("Expected differences to be ignored by rules but got %+v", differences)
+	}
+
+	invalid := "matching_rules:\n  - name: ignore_status\n    value:\n      codes: [503]\ninteractions: []\n"
+	if err = NewManifest().Parse(strings.NewReader(invalid)); err == nil {
+		t.Error("Expected rule value not matching schema to be rejected")
+	}
+}
+
+func TestLintManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apidifftest")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"main.yaml": `include: [common.yaml]
+matching_rules:
+  - name: match_body
+    value: true
+  - name: match_url
+    value: true
+  - name: match
+    value: {path: true}
+interactions:
+  - url: "https://example.com/a"
+    method: fetch
+  - url: "{{baseUrl}}/users"
+    method: get
+  - url: "ftp://example.com/b"
+    method: get
+  - url: "https://example.com/c"
+    method: get
+  - url: "https://example.com/d"
+    method: get
+    matching_rules:
+      - name: match
+        value: {method: true}
+`,
+		"common.yaml": `version: 1
+interactions:
+  - url: "https://example.com/c"
+    method: get
+`,
+	}
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			panic(err)
+		}
+	}
+
+	issues, err := New("", Options{}).Lint(filepath.Join(dir, "main.yaml"))
+	if err != nil {
+		panic(err)
+	}
+
+	var found []string
+	for _, issue := range issues {
+		found = append(found, fmt.Sprintf("%s:%d:%s", filepath.Base(issue.File), issue.Line, issue.Severity))
+	}
+	expected := []string{
+		"main.yaml:1:warning",  // missing version
+		"main.yaml:3:warning",  // unknown rule
+		"main.yaml:7:warning",  // ignored request matcher
+		"main.yaml:11:error",   // invalid method
+		"main.yaml:12:warning", // unresolved variable
+		"main.yaml:14:error",   // invalid URL
+		"main.yaml:20:warning", // ignored request matcher of interaction
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Expected lint issues %v but got %v", expected, issues)
+	}
+}
+
 func TestIsValidURL(t *testing.T) {
 	urls := []string{
 		"http://www.example.com",
@@ -334,31 +596,2252 @@ func TestNonEmptyUI(t *testing.T) {
 	}
 }
 
-func readExampleManifest(filename string, t *testing.T) *Manifest {
-	path := path.Join("examples", filename)
+func TestReplayServer(t *testing.T) {
+	path, err := makeTempStorageDirectory()
+	if err != nil {
+		panic(err)
+	}
+	defer removeTempStorageDirectory(path)
 
-	reader, err := os.Open(path)
+	api := newTestAPI()
+	defer api.Close()
+
+	ad := New(path, Options{})
+	interaction := RequestInteraction{
+		URL:    api.URL + "/posts/1",
+		Method: "get",
+	}
+	if err = ad.Record(path, sessionName, interaction, RequestInfo{}, nil); err != nil {
+		panic(err)
+	}
+
+	handler, err := ad.NewReplayHandler(sessionName, nil, ServeOptions{})
 	if err != nil {
 		panic(err)
 	}
-	defer reader.Close()
+	mock := httptest.NewServer(handler)
+	defer mock.Close()
 
-	manifest := NewManifest()
-	if err := manifest.Parse(reader); err != nil {
+	resp, err := http.Get(mock.URL + "/posts/1")
+	if err != nil {
 		panic(err)
 	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
 
-	return manifest
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected to replay status 200 but got %d", resp.StatusCode)
+	}
+	if string(body) != `{"id":1,"path":"/posts/1"}` {
+		t.Errorf("Expected to replay recorded body but got %q", body)
+	}
+
+	resp, err = http.Get(mock.URL + "/posts/2")
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected unmatched request to return 404 but got %d", resp.StatusCode)
+	}
+
+	// failing on unmatched request
+	handler, err = ad.NewReplayHandler(sessionName, nil, ServeOptions{Unmatched: UnmatchedFail})
+	if err != nil {
+		panic(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/posts/2", nil))
+
+	select {
+	case <-handler.Failures():
+	default:
+		t.Error("Expected unmatched request to be reported as failure")
+	}
 }
 
-func makeTempStorageDirectory() (string, error) {
-	dir, err := ioutil.TempDir("/tmp", "apidifftest")
+func TestShadowProxy(t *testing.T) {
+	primary := newTestAPI()
+	defer primary.Close()
+
+	candidate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, `{"id":2,"path":%q}`, r.URL.Path)
+	}))
+	defer candidate.Close()
+
+	ad := New("", Options{})
+	proxy, err := ad.NewShadowProxy(ShadowOptions{
+		Primary:   primary.URL,
+		Candidate: candidate.URL,
+	})
 	if err != nil {
-		return "", err
+		panic(err)
 	}
-	return dir, nil
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/posts/1")
+	if err != nil {
+		panic(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != `{"id":1,"path":"/posts/1"}` {
+		t.Errorf("Expected to get primary response but got %q", body)
+	}
+
+	proxy.Wait()
+	session, differences := proxy.Report()
+
+	if len(session.Interactions) != 1 {
+		t.Fatalf("Expected to have 1 shadowed interaction but got %d", len(session.Interactions))
+	}
+	if !differences[0].Changed || len(differences[0].Body) == 0 {
+		t.Error("Expect to have different JSON payload but got same")
+	}
+
+	// unreachable candidate is reported and repeated requests are stored
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	ad = NewWithStorage("", NewMemoryStorage(), Options{})
+	proxy, err = ad.NewShadowProxy(ShadowOptions{
+		Name:      sessionName,
+		Primary:   primary.URL,
+		Candidate: unreachable.URL,
+	})
+	if err != nil {
+		panic(err)
+	}
+	server = httptest.NewServer(proxy)
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err = http.Get(server.URL + "/posts/1")
+		if err != nil {
+			panic(err)
+		}
+		resp.Body.Close()
+	}
+
+	proxy.Wait()
+	session, differences = proxy.Report()
+	if len(session.Interactions) != 2 {
+		t.Fatalf("Expected to have 2 shadowed interactions but got %d", len(session.Interactions))
+	}
+	for i := range session.Interactions {
+		if !differences[i].Changed || differences[i].Body["candidate"] == nil {
+			t.Errorf("Expected unreachable candidate to be reported for interaction %d but got %v", i, differences[i])
+		}
+	}
+
+	stored, err := ad.Show(sessionName)
+	if err != nil {
+		panic(err)
+	}
+	if len(stored.Interactions) != len(session.Interactions) {
+		t.Errorf("Expected to store %d repeated interactions but got %d", len(session.Interactions), len(stored.Interactions))
+	}
+
+	// mirrored request outlives failed primary and client request
+	release := make(chan struct{})
+	mirroredHeader := make(chan string, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirroredHeader <- r.Header.Get("X-Shadow")
+		<-release
+	}))
+	defer slow.Close()
+
+	proxy, err = ad.NewShadowProxy(ShadowOptions{
+		Primary:   unreachable.URL,
+		Candidate: slow.URL,
+	})
+	if err != nil {
+		panic(err)
+	}
+	server = httptest.NewServer(proxy)
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/posts/1", nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("X-Shadow", "mirrored")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected to get status %d but got %d", http.StatusBadGateway, resp.StatusCode)
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		proxy.Wait()
+		close(waited)
+	}()
+	if header := <-mirroredHeader; header != "mirrored" {
+		t.Errorf("Expected to mirror header %q but got %q", "mirrored", header)
+	}
+	select {
+	case <-waited:
+		t.Error("Expected Wait to block until mirrored request is finished but got returned")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-waited
 }
 
-func removeTempStorageDirectory(path string) error {
-	return os.RemoveAll(path)
+func TestManifestFromOpenAPI(t *testing.T) {
+	spec := `
+openapi: 3.0.0
+servers:
+  - url: https://api.example.com/v1
+paths:
+  /users/{id}:
+    get:
+      summary: Get user
+      tags: [users]
+      parameters:
+        - name: id
+          in: path
+          required: true
+          example: 42
+        - name: fields
+          in: query
+          schema:
+            type: string
+            example: name
+      responses:
+        200:
+          description: OK
+  /users:
+    post:
+      operationId: createUser
+      tags: [users, admin]
+      requestBody:
+        content:
+          application/json:
+            schema:
+              $ref: '#/components/schemas/User'
+      responses:
+        "201":
+          description: Created
+  /health:
+    get:
+      tags: [ops]
+      responses:
+        "204":
+          description: No Content
+components:
+  schemas:
+    User:
+      type: object
+      properties:
+        name:
+          type: string
+          example: John
+`
+
+	manifest, err := NewManifestFromOpenAPI(strings.NewReader(spec), OpenAPIOptions{
+		Tags:       []string{"users"},
+		PathPrefix: "/users",
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if len(manifest.Interactions) != 2 {
+		t.Fatalf("Expected to generate 2 interactions but got %d", len(manifest.Interactions))
+	}
+
+	create := manifest.Interactions[0]
+	if create.Name != "createUser" || create.Method != "post" || create.StatusCode != 201 {
+		t.Errorf("Expected to generate createUser operation but got %+v", create)
+	}
+	if create.Payload != `{"name":"John"}` {
+		t.Errorf("Expected to generate payload from schema example but got %q", create.Payload)
+	}
+	if create.Headers.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected JSON content type but got %q", create.Headers.Get("Content-Type"))
+	}
+
+	get := manifest.Interactions[1]
+	if get.URL != "https://api.example.com/v1/users/42?fields=name" {
+		t.Errorf("Expected to fill path and query parameters but got %q", get.URL)
+	}
+	if get.StatusCode != 200 {
+		t.Errorf("Expected to have status 200 but got %d", get.StatusCode)
+	}
+}
+
+func TestImportHAR(t *testing.T) {
+	path, err := makeTempStorageDirectory()
+	if err != nil {
+		panic(err)
+	}
+	defer removeTempStorageDirectory(path)
+
+	document := `{"log": {"version": "1.2", "entries": [
+		{
+			"startedDateTime": "2019-01-01T10:00:00.000Z",
+			"request": {"method": "GET", "url": "https://api.example.com/users/1",
+				"headers": [{"name": "Accept", "value": "application/json"}, {"name": "Host", "value": "api.example.com"}]},
+			"response": {"status": 200, "statusText": "OK",
+				"headers": [{"name": "Content-Type", "value": "application/json"}],
+				"content": {"mimeType": "application/json", "text": "{\"id\":1}"}},
+			"timings": {"dns": 5, "connect": 30, "ssl": 20, "send": 1, "wait": 40, "receive": 3}
+		},
+		{
+			"startedDateTime": "2019-01-01T10:00:01.000Z",
+			"request": {"method": "GET", "url": "https://cdn.example.com/logo.png", "headers": []},
+			"response": {"status": 200, "statusText": "OK", "headers": [],
+				"content": {"mimeType": "image/png", "text": "iVBORw0KGgo=", "encoding": "base64"}},
+			"timings": {"dns": -1, "connect": -1, "ssl": -1, "send": 0, "wait": 10, "receive": 1}
+		}
+	]}}`
+
+	har, err := ParseHAR(strings.NewReader(document))
+	if err != nil {
+		panic(err)
+	}
+
+	filter := HARFilter{Hosts: []string{"api.example.com"}}
+	manifest := har.Manifest(filter)
+
+	if len(manifest.Interactions) != 1 {
+		t.Fatalf("Expected to import 1 interaction but got %d", len(manifest.Interactions))
+	}
+	if manifest.Interactions[0].Headers.Get("Host") != "" {
+		t.Error("Expected Host header to be skipped")
+	}
+
+	ad := New(path, Options{})
+	session, err := ad.ImportHAR(sessionName, har, HARFilter{ContentTypes: []string{"application/json"}})
+	if err != nil {
+		panic(err)
+	}
+
+	if len(session.Interactions) != 1 {
+		t.Fatalf("Expected to import 1 interaction but got %d", len(session.Interactions))
+	}
+
+	expected := RequestStats{
+		DNSLookup:        5,
+		TCPConnection:    10,
+		TLSHandshake:     20,
+		ServerProcessing: 41,
+		ContentTransfer:  3,
+	}
+	if session.Interactions[0].Stats != expected {
+		t.Errorf("Expected to derive stats %+v but got %+v", expected, session.Interactions[0].Stats)
+	}
+
+	// repeated requests are kept and imported version is returned even
+	// when another one is pinned
+	if err = ad.Pin(sessionName, 1); err != nil {
+		panic(err)
+	}
+	har.Log.Entries = append(har.Log.Entries, har.Log.Entries[0])
+	session, err = ad.ImportHAR(sessionName, har, HARFilter{ContentTypes: []string{"application/json"}})
+	if err != nil {
+		panic(err)
+	}
+	if session.Version != 2 || len(session.Interactions) != 2 {
+		t.Errorf("Expected version 2 with 2 interactions but got version %d with %d", session.Version, len(session.Interactions))
+	}
+
+	// manifest interactions of repeats reach their stored occurrences
+	fingerprints, err := ad.Storage.Interactions(versionKey(sessionName, 2))
+	if err != nil {
+		panic(err)
+	}
+	stored := make(map[string]bool)
+	for _, fingerprint := range fingerprints {
+		stored[fingerprint] = true
+	}
+	repeated := har.Manifest(HARFilter{ContentTypes: []string{"application/json"}})
+	if len(repeated.Interactions) != 2 {
+		t.Fatalf("Expected to convert 2 interactions but got %d", len(repeated.Interactions))
+	}
+	for _, interaction := range repeated.Interactions {
+		if !stored[interaction.Fingerprint()] {
+			t.Errorf("Expected %q to be stored but got %v", interaction.Fingerprint(), fingerprints)
+		}
+		delete(stored, interaction.Fingerprint())
+	}
+	if len(stored) != 0 {
+		t.Errorf("Expected every stored occurrence to have manifest interaction but got %v left", stored)
+	}
+
+	// failed import does not leave version behind
+	har.Log.Entries[1].Response.Content.Text = "not base64"
+	if _, err = ad.ImportHAR(sessionName, har, HARFilter{}); err == nil {
+		t.Error("Expected invalid entry to fail import")
+	}
+	metadata, err := ad.metadata(sessionName)
+	if err != nil {
+		panic(err)
+	}
+	if len(metadata.Versions) != 2 {
+		t.Errorf("Expected failed import to be discarded but got %d versions", len(metadata.Versions))
+	}
+}
+
+func TestImportPostmanCollection(t *testing.T) {
+	collection := `{
+		"info": {"name": "Example", "schema": "https://schema.getpostman.com/json/collection/v2.1.0/collection.json"},
+		"variable": [{"key": "baseUrl", "value": "https://api.example.com"}],
+		"auth": {"type": "basic", "basic": [
+			{"key": "username", "value": "john"},
+			{"key": "password", "value": "secret"}
+		]},
+		"item": [
+			{"name": "Users", "item": [
+				{"name": "Create user", "request": {
+					"method": "POST",
+					"header": [{"key": "Accept", "value": "application/json"}],
+					"url": {"raw": "{{baseUrl}}/users", "host": ["{{baseUrl}}"], "path": ["users"]},
+					"body": {"mode": "urlencoded", "urlencoded": [{"key": "name", "value": "John"}]}
+				}},
+				{"name": "Me", "request": {"auth": {"type": "inherit"}, "url": "{{baseUrl}}/me"}}
+			]},
+			{"name": "Health", "request": "{{baseUrl}}/health"},
+			{"name": "Tokens", "request": {"auth": {"type": "oauth2"}, "url": "{{baseUrl}}/tokens"}}
+		]
+	}`
+
+	manifest, warnings, err := NewManifestFromPostman(strings.NewReader(collection), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(manifest.Interactions) != 4 {
+		t.Fatalf("Expected to import 4 interactions but got %d", len(manifest.Interactions))
+	}
+
+	create := manifest.Interactions[0]
+	if create.Name != "Users / Create user" {
+		t.Errorf("Expected to have folder in name but got %q", create.Name)
+	}
+	if create.URL != "https://api.example.com/users" || create.Method != "post" {
+		t.Errorf("Expected to substitute collection variables but got %s %q", create.Method, create.URL)
+	}
+	if create.Payload != "name=John" {
+		t.Errorf("Expected to encode form payload but got %q", create.Payload)
+	}
+	if create.Headers.Get("Authorization") != "Basic am9objpzZWNyZXQ=" {
+		t.Errorf("Expected to inherit collection auth but got %q", create.Headers.Get("Authorization"))
+	}
+
+	if manifest.Interactions[1].Headers.Get("Authorization") != "Basic am9objpzZWNyZXQ=" {
+		t.Errorf("Expected to inherit folder auth but got %q", manifest.Interactions[1].Headers.Get("Authorization"))
+	}
+
+	if manifest.Interactions[2].URL != "https://api.example.com/health" {
+		t.Errorf("Expected to import request defined as URL but got %q", manifest.Interactions[2].URL)
+	}
+
+	// unsupported authorization does not abort import
+	tokens := manifest.Interactions[3]
+	if tokens.Headers.Get("Authorization") != "" {
+		t.Errorf("Expected to import request without authorization but got %q", tokens.Headers.Get("Authorization"))
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "Tokens") || !strings.Contains(warnings[0], "oauth2") {
+		t.Errorf("Expected to warn about unsupported authorization of Tokens but got %v", warnings)
+	}
+}
+
+func TestImportCurlCommands(t *testing.T) {
+	commands := `
+# create user
+$ curl -sS -X PUT 'https://api.example.com/users/1' \
+    -H 'Content-Type: application/json' \
+    --data-raw '{"name": "John Doe"}'
+
+curl -G https://api.example.com/search -d q=john -u admin:secret
+`
+
+	manifest, err := NewManifestFromCurl(strings.NewReader(commands))
+	if err != nil {
+		panic(err)
+	}
+
+	if len(manifest.Interactions) != 2 {
+		t.Fatalf("Expected to import 2 interactions but got %d", len(manifest.Interactions))
+	}
+
+	update := manifest.Interactions[0]
+	if update.Method != "put" || update.URL != "https://api.example.com/users/1" {
+		t.Errorf("Expected to parse method and URL but got %s %q", update.Method, update.URL)
+	}
+	if update.Payload != `{"name": "John Doe"}` {
+		t.Errorf("Expected to parse payload but got %q", update.Payload)
+	}
+	if update.Headers.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected to keep content type but got %q", update.Headers.Get("Content-Type"))
+	}
+
+	search := manifest.Interactions[1]
+	if search.Method != "get" || search.URL != "https://api.example.com/search?q=john" {
+		t.Errorf("Expected to append data to query but got %s %q", search.Method, search.URL)
+	}
+	if search.Headers.Get("Authorization") != "Basic YWRtaW46c2VjcmV0" {
+		t.Errorf("Expected basic authorization but got %q", search.Headers.Get("Authorization"))
+	}
+}
+
+func TestRecordInteractionHeaders(t *testing.T) {
+	var received []http.Header
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header)
+		fmt.Fprint(w, `{}`)
+	}))
+	defer api.Close()
+
+	manifest, err := NewManifestFromCurl(strings.NewReader(fmt.Sprintf(`
+curl -X POST %[1]s/users -H 'Content-Type: application/xml' -H 'X-Tenant: acme' -d '<user/>'
+curl %[1]s/users -u admin:secret -H 'Accept: text/plain'
+`, api.URL)))
+	if err != nil {
+		panic(err)
+	}
+	manifest.Request.Headers = http.Header{"Accept": {"application/json"}, "X-Client": {"apidiff"}}
+
+	ad := NewWithStorage("", NewMemoryStorage(), Options{})
+	if _, err = ad.RecordVersion(sessionName, *manifest); err != nil {
+		panic(err)
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 requests but got %d", len(received))
+	}
+	expected := []map[string]string{
+		{"Content-Type": "application/xml", "X-Tenant": "acme", "Accept": "application/json", "X-Client": "apidiff"},
+		{"Authorization": "Basic YWRtaW46c2VjcmV0", "Accept": "text/plain", "X-Client": "apidiff"},
+	}
+	for i, headers := range expected {
+		for key, value := range headers {
+			if got := received[i].Get(key); got != value {
+				t.Errorf("Expected request %d header %s %q but got %q", i, key, value, got)
+			}
+		}
+	}
+	if accept := received[1]["Accept"]; len(accept) != 1 {
+		t.Errorf("Expected interaction header to replace shared one but got %v", accept)
+	}
+}
+
+func TestExportSession(t *testing.T) {
+	path, err := makeTempStorageDirectory()
+	if err != nil {
+		panic(err)
+	}
+	defer removeTempStorageDirectory(path)
+
+	api := newTestAPI()
+	defer api.Close()
+
+	ad := New(path, Options{})
+	for _, p := range []string{"/posts/1", "/posts/2?fields=id"} {
+		interaction := RequestInteraction{URL: api.URL + p, Method: "get"}
+		if err = ad.Record(path, sessionName, interaction, RequestInfo{}, nil); err != nil {
+			panic(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = ad.ExportHAR(sessionName, &buf); err != nil {
+		panic(err)
+	}
+
+	har, err := ParseHAR(&buf)
+	if err != nil {
+		panic(err)
+	}
+	if len(har.Log.Entries) != 2 {
+		t.Fatalf("Expected to export 2 entries but got %d", len(har.Log.Entries))
+	}
+	if har.Log.Entries[0].Response.Status != http.StatusOK {
+		t.Errorf("Expected to export status 200 but got %d", har.Log.Entries[0].Response.Status)
+	}
+
+	buf.Reset()
+	if err = ad.ExportOpenAPI(sessionName, &buf); err != nil {
+		panic(err)
+	}
+
+	draft := buf.String()
+	for _, expected := range []string{"/posts/{postId}:", "name: fields", "type: integer", `"200":`} {
+		if !strings.Contains(draft, expected) {
+			t.Errorf("Expected OpenAPI draft to contain %q but got:\n%s", expected, draft)
+		}
+	}
+}
+
+func readExampleManifest(filename string, t *testing.T) *Manifest {
+	path := path.Join("examples", filename)
+
+	reader, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+
+	manifest := NewManifest()
+	if err := manifest.Parse(reader); err != nil {
+		panic(err)
+	}
+
+	return manifest
+}
+
+func makeTempStorageDirectory() (string, error) {
+	dir, err := ioutil.TempDir("/tmp", "apidifftest")
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func removeTempStorageDirectory(path string) error {
+	return os.RemoveAll(path)
+}
+
+func TestFingerprints(t *testing.T) {
+	first := RequestInteraction{URL: "http://a/b", Method: "get"}
+	second := RequestInteraction{URL: "http://a/bge", Method: "t"}
+
+	if first.LegacyFingerprint() != second.LegacyFingerprint() {
+		t.Error("Expected legacy fingerprints to collide")
+	}
+	if first.Fingerprint() == second.Fingerprint() {
+		t.Errorf("Expected different fingerprints but got %s", first.Fingerprint())
+	}
+	if !strings.HasPrefix(first.Fingerprint(), FingerprintVersion+"-") {
+		t.Errorf("Expected versioned fingerprint but got %s", first.Fingerprint())
+	}
+
+	ordered := RequestInteraction{URL: "HTTP://Example.com:80?b=2&a=1", Method: "GET"}
+	reordered := RequestInteraction{URL: "http://example.com/?a=1&b=2", Method: "get"}
+	if ordered.Fingerprint() != reordered.Fingerprint() {
+		t.Error("Expected equivalent URLs to share fingerprint")
+	}
+
+	manifest := Manifest{Interactions: []RequestInteraction{first, second, reordered, ordered}}
+	duplicates := manifest.DuplicateFingerprints()
+	if len(duplicates) != 1 || len(duplicates[ordered.Fingerprint()]) != 2 {
+		t.Errorf("Expected 1 duplicated fingerprint but got %v", duplicates)
+	}
+}
+
+func TestFingerprintComposition(t *testing.T) {
+	document := `
+version: 1
+fingerprint:
+  method: true
+  path: true
+  query: [page]
+  body_json: [user.id]
+interactions:
+  - url: http://localhost/users?page=1&ts=1
+    method: post
+    body: '{"user": {"id": 1, "name": "foo"}}'
+  - url: http://127.0.0.1/users?ts=2&page=1
+    method: POST
+    headers:
+      X-Request-Id: [abc]
+    body: '{"user": {"name": "bar", "id": 1}}'
+  - id: create-user
+    url: http://localhost/users
+    method: post
+`
+
+	manifest := NewManifest()
+	if err := manifest.Parse(strings.NewReader(document)); err != nil {
+		panic(err)
+	}
+
+	first, second, third := manifest.Interactions[0], manifest.Interactions[1], manifest.Interactions[2]
+	if first.Fingerprint() != second.Fingerprint() {
+		t.Error("Expected cosmetic changes not to affect fingerprint")
+	}
+	if third.Fingerprint() != "id-create-user" {
+		t.Errorf("Expected id-create-user fingerprint but got %s", third.Fingerprint())
+	}
+	if len(manifest.DuplicateFingerprints()) != 1 {
+		t.Errorf("Expected 1 duplicated fingerprint but got %v", manifest.DuplicateFingerprints())
+	}
+
+	// baseline recorded without composition is still found
+	defaults := first
+	defaults.fingerprint = nil
+	found := false
+	for _, fingerprint := range first.previousFingerprints() {
+		if fingerprint == defaults.Fingerprint() {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected default fingerprint to be one of previous fingerprints")
+	}
+
+	// selected headers are matched regardless of their case
+	tenants := NewManifest()
+	err := tenants.Parse(strings.NewReader(`
+version: 1
+fingerprint:
+  path: true
+  headers: [X-Tenant]
+interactions:
+  - url: http://localhost/users
+    method: get
+    headers:
+      x-tenant: [foo]
+  - url: http://localhost/users
+    method: get
+    headers:
+      x-tenant: [bar]
+  - url: http://localhost/users
+    method: get
+    headers:
+      X-TENANT: [foo]
+`))
+	if err != nil {
+		panic(err)
+	}
+	foo, bar, upper := tenants.Interactions[0], tenants.Interactions[1], tenants.Interactions[2]
+	if foo.Fingerprint() == bar.Fingerprint() {
+		t.Error("Expected lower case header to be part of fingerprint")
+	}
+	if foo.Fingerprint() != upper.Fingerprint() {
+		t.Error("Expected header case not to affect fingerprint")
+	}
+
+	// "*" selects the whole query regardless of order of parameters
+	queries := NewManifest()
+	err = queries.Parse(strings.NewReader(`
+version: 1
+fingerprint:
+  path: true
+  query: ["*"]
+interactions:
+  - url: http://localhost/users?page=1&ts=1
+    method: get
+  - url: http://localhost/users?ts=1&page=1
+    method: get
+  - url: http://localhost/users?page=1&ts=2
+    method: get
+`))
+	if err != nil {
+		panic(err)
+	}
+	if queries.Interactions[0].Fingerprint() != queries.Interactions[1].Fingerprint() {
+		t.Error("Expected order of query parameters not to affect fingerprint")
+	}
+	if queries.Interactions[0].Fingerprint() == queries.Interactions[2].Fingerprint() {
+		t.Error("Expected every query parameter to be part of fingerprint")
+	}
+
+	queries.Fingerprint.Query = []string{"*", "page"}
+	if problems := queries.problems(true); len(problems) != 1 || !strings.Contains(problems[0].message, `"*"`) {
+		t.Errorf("Expected query keys next to \"*\" to be reported but got %v", problems)
+	}
+
+	invalid := []string{
+		"version: 1\nfingerprint: {}\ninteractions: []",
+		"version: 1\ninteractions:\n  - id: ../foo\n    url: http://localhost\n    method: get",
+	}
+	for _, document := range invalid {
+		if err := NewManifest().Parse(strings.NewReader(document)); err == nil {
+			t.Errorf("Expected %q to be invalid manifest", document)
+		}
+	}
+}
+
+func TestMigrateLegacySession(t *testing.T) {
+	path, err := makeTempStorageDirectory()
+	if err != nil {
+		panic(err)
+	}
+	defer removeTempStorageDirectory(path)
+
+	server := newTestAPI()
+	defer server.Close()
+
+	interaction := RequestInteraction{URL: server.URL + "/users", Method: "get"}
+	manifest := Manifest{Interactions: []RequestInteraction{interaction}}
+
+	ad := New(path, Options{})
+	if err = ad.Record(path, sessionName, interaction, RequestInfo{}, nil); err != nil {
+		panic(err)
+	}
+
+	// emulates unversioned session recorded by previous version
+	sessionPath := filepath.Join(path, sessionName)
+	for _, suffix := range []string{".yaml", "_stats.yaml"} {
+		err = os.Rename(
+			filepath.Join(sessionPath, "v1", interaction.Fingerprint()+suffix),
+			filepath.Join(sessionPath, interaction.LegacyFingerprint()+suffix),
+		)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if err = os.RemoveAll(filepath.Join(sessionPath, "v1")); err != nil {
+		panic(err)
+	}
+	if err = os.Remove(filepath.Join(sessionPath, metadataFile)); err != nil {
+		panic(err)
+	}
+
+	session, err := ad.Show(sessionName)
+	if err != nil {
+		panic(err)
+	}
+	if !session.Legacy {
+		t.Error("Expected session to use legacy fingerprints")
+	}
+
+	differences, err := ad.Compare(session, manifest)
+	if err != nil {
+		panic(err)
+	}
+	if differences[0].Changed {
+		t.Errorf("Expected legacy session to be compared but got %+v", differences[0])
+	}
+
+	migrated, err := ad.Migrate(sessionName, manifest)
+	if err != nil {
+		panic(err)
+	}
+	if migrated != 1 {
+		t.Errorf("Expected to migrate 1 interaction but got %d", migrated)
+	}
+
+	session, err = ad.Show(sessionName)
+	if err != nil {
+		panic(err)
+	}
+	if session.Legacy || len(session.Interactions) != 1 {
+		t.Errorf("Expected migrated session with 1 interaction but got %+v", session)
+	}
+}
+
+func TestStorageBackends(t *testing.T) {
+	path, err := makeTempStorageDirectory()
+	if err != nil {
+		panic(err)
+	}
+	defer removeTempStorageDirectory(path)
+
+	server := newTestAPI()
+	defer server.Close()
+
+	storages := map[string]Storage{
+		"file":    NewFileStorage(filepath.Join(path, "sessions")),
+		"memory":  NewMemoryStorage(),
+		"archive": NewArchiveStorage(filepath.Join(path, "sessions.tar.gz")),
+	}
+
+	interactions := []RequestInteraction{
+		{URL: server.URL + "/users", Method: "get"},
+		{URL: server.URL + "/posts", Method: "get"},
+	}
+
+	for kind, storage := range storages {
+		ad := NewWithStorage(path, storage, Options{})
+		for _, interaction := range interactions {
+			if err = ad.Record(path, sessionName, interaction, RequestInfo{}, nil); err != nil {
+				panic(err)
+			}
+		}
+
+		sessions, err := ad.List()
+		if err != nil {
+			panic(err)
+		}
+		if len(sessions) != 1 || len(sessions[0].Interactions) != 2 {
+			t.Fatalf("Expected %s storage to list 1 session with 2 interactions but got %+v", kind, sessions)
+		}
+
+		c, stats, err := ad.Detail(sessionName, 1)
+		if err != nil {
+			panic(err)
+		}
+		if c.Response.Code != http.StatusOK || stats == nil {
+			t.Errorf("Expected %s storage to load interaction with stats but got %+v", kind, c.Response)
+		}
+
+		key := versionKey(sessionName, 1)
+		if err = storage.DeleteInteraction(key, interactions[0].Fingerprint()); err != nil {
+			panic(err)
+		}
+		fingerprints, err := storage.Interactions(key)
+		if err != nil {
+			panic(err)
+		}
+		if len(fingerprints) != 1 || fingerprints[0] != interactions[1].Fingerprint() {
+			t.Errorf("Expected %s storage to keep 1 interaction but got %v", kind, fingerprints)
+		}
+
+		if err = ad.Delete(sessionName); err != nil {
+			panic(err)
+		}
+		if err = ad.Delete(sessionName); err == nil {
+			t.Errorf("Expected %s storage to fail deleting missing session", kind)
+		}
+		if _, err = storage.Interactions("../" + sessionName); err == nil {
+			t.Errorf("Expected %s storage to reject invalid session name", kind)
+		}
+	}
+}
+
+func TestSessionArchive(t *testing.T) {
+	server := newTestAPI()
+	defer server.Close()
+
+	source := NewWithStorage("", NewMemoryStorage(), Options{})
+	for _, p := range []string{"/users", "/posts"} {
+		interaction := RequestInteraction{URL: server.URL + p, Method: "get"}
+		if err := source.Record("", sessionName, interaction, RequestInfo{}, nil); err != nil {
+			panic(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	if err := source.ExportSession(sessionName, &archive); err != nil {
+		panic(err)
+	}
+
+	target := NewWithStorage("", NewMemoryStorage(), Options{})
+	session, err := target.ImportSession(bytes.NewReader(archive.Bytes()), "", false)
+	if err != nil {
+		panic(err)
+	}
+	if session.Name != sessionName || len(session.Interactions) != 2 {
+		t.Errorf("Expected to import session %q with 2 interactions but got %+v", sessionName, session)
+	}
+
+	if _, err = target.ImportSession(bytes.NewReader(archive.Bytes()), "", false); err == nil {
+		t.Error("Expected import of existing session to be refused")
+	}
+	session, err = target.ImportSession(bytes.NewReader(archive.Bytes()), "", true)
+	if err != nil {
+		panic(err)
+	}
+	if session.Name != sessionName+"-2" {
+		t.Errorf("Expected to rename imported session to %q but got %q", sessionName+"-2", session.Name)
+	}
+
+	// tamper with a recorded response
+	files, err := readArchive(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		panic(err)
+	}
+	for i := range files {
+		if strings.HasSuffix(files[i].Name, cassetteSuffix) && !strings.HasSuffix(files[i].Name, statsSuffix) {
+			files[i].Data = bytes.Replace(files[i].Data, []byte("200"), []byte("500"), -1)
+			break
+		}
+	}
+	var tampered bytes.Buffer
+	if err = writeArchive(&tampered, files); err != nil {
+		panic(err)
+	}
+	if _, err = target.ImportSession(&tampered, "bar", false); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("Expected checksum verification to fail but got %v", err)
+	}
+}
+
+func TestSessionVersions(t *testing.T) {
+	release := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, `{"id":1,"release":%d}`, release)
+	}))
+	defer server.Close()
+
+	manifest := Manifest{
+		Interactions: []RequestInteraction{
+			{URL: server.URL + "/users", Method: "get"},
+		},
+	}
+
+	ad := NewWithStorage("", NewMemoryStorage(), Options{})
+	for release = 1; release <= 3; release++ {
+		version, err := ad.RecordVersion(sessionName, manifest)
+		if err != nil {
+			panic(err)
+		}
+		if version != release {
+			t.Errorf("Expected to record version %d but got %d", release, version)
+		}
+	}
+
+	versions, current, err := ad.History(sessionName)
+	if err != nil {
+		panic(err)
+	}
+	if len(versions) != 3 || current != 3 {
+		t.Errorf("Expected 3 versions with baseline 3 but got %d versions with baseline %d", len(versions), current)
+	}
+
+	differences, err := ad.CompareVersions(sessionName, 1, 2, nil)
+	if err != nil {
+		panic(err)
+	}
+	if len(differences) != 1 || !differences[0].Changed {
+		t.Errorf("Expected versions 1 and 2 to differ but got %+v", differences)
+	}
+
+	if err = ad.Pin(sessionName, 1); err != nil {
+		panic(err)
+	}
+	session, err := ad.Show(sessionName)
+	if err != nil {
+		panic(err)
+	}
+	if session.Version != 1 {
+		t.Errorf("Expected pinned version 1 to be shown but got %d", session.Version)
+	}
+
+	pruned, err := ad.Prune(sessionName, 1)
+	if err != nil {
+		panic(err)
+	}
+	if len(pruned) != 1 || pruned[0] != 2 {
+		t.Errorf("Expected to prune version 2 but got %v", pruned)
+	}
+	if _, err = ad.ShowVersion(sessionName, 2); err == nil {
+		t.Error("Expected pruned version to be missing")
+	}
+}
+
+func TestAcceptDifferences(t *testing.T) {
+	release := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, `{"path":%q,"release":%d}`, r.URL.Path, release)
+	}))
+	defer server.Close()
+
+	manifest := Manifest{
+		Interactions: []RequestInteraction{
+			{URL: server.URL + "/users", Method: "get"},
+			{URL: server.URL + "/posts", Method: "get", Name: "posts"},
+		},
+		MatchingRules: []MatchingRules{
+			{Name: "ignore_headers", Value: []interface{}{"Date"}},
+		},
+	}
+
+	ad := NewWithStorage("", NewMemoryStorage(), Options{})
+	if _, err := ad.RecordVersion(sessionName, manifest); err != nil {
+		panic(err)
+	}
+	session, err := ad.Show(sessionName)
+	if err != nil {
+		panic(err)
+	}
+
+	release = 2
+	version, accepted, err := ad.Accept(session, manifest, AcceptSelected("posts"))
+	if err != nil {
+		panic(err)
+	}
+	if version != 2 || len(accepted) != 1 || accepted[0] != 1 {
+		t.Errorf("Expected interaction 1 accepted as version 2 but got %v as version %d", accepted, version)
+	}
+
+	expected := map[string]string{"/users": `"release":1`, "/posts": `"release":2`}
+	for _, interaction := range manifest.Interactions {
+		stored, err := ad.Storage.LoadInteraction(versionKey(sessionName, 2), interaction.Fingerprint())
+		if err != nil {
+			panic(err)
+		}
+		path := strings.TrimPrefix(interaction.URL, server.URL)
+		if !strings.Contains(stored.Interaction().Response.Body, expected[path]) {
+			t.Errorf("Expected %s response of version 2 to contain %s but got %s", path, expected[path], stored.Interaction().Response.Body)
+		}
+	}
+
+	versions, _, err := ad.History(sessionName)
+	if err != nil {
+		panic(err)
+	}
+	if len(versions) != 2 {
+		t.Errorf("Expected previous version to be kept but got %d versions", len(versions))
+	}
+
+	session, err = ad.Show(sessionName)
+	if err != nil {
+		panic(err)
+	}
+	_, accepted, err = ad.Accept(session, manifest, AcceptSelected("0", "1"))
+	if err != nil {
+		panic(err)
+	}
+	if len(accepted) != 1 || accepted[0] != 0 {
+		t.Errorf("Expected only changed interaction 0 to be accepted but got %v", accepted)
+	}
+}
+
+func TestAcceptMatchedDifferences(t *testing.T) {
+	release := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, `{"release":%d}`, release)
+	}))
+	defer server.Close()
+
+	manifest := func(ts int) Manifest {
+		return Manifest{
+			Interactions: []RequestInteraction{
+				{URL: fmt.Sprintf("%s/search?q=a&ts=%d", server.URL, ts), Method: "get"},
+			},
+			MatchingRules: []MatchingRules{
+				{Name: "ignore_headers", Value: []interface{}{"Date"}},
+				{Name: "match", Value: map[interface{}]interface{}{
+					"method": true, "path": true, "query": true, "ignore_query": []interface{}{"ts"},
+				}},
+			},
+		}
+	}
+
+	ad := NewWithStorage("", NewMemoryStorage(), Options{})
+	if _, err := ad.RecordVersion(sessionName, manifest(1)); err != nil {
+		panic(err)
+	}
+	session, err := ad.Show(sessionName)
+	if err != nil {
+		panic(err)
+	}
+
+	// accepted interaction replaces the one it was paired with
+	release = 2
+	version, accepted, err := ad.Accept(session, manifest(2), AcceptSelected("all"))
+	if err != nil {
+		panic(err)
+	}
+	if len(accepted) != 1 {
+		t.Fatalf("Expected matched interaction to be accepted but got %v", accepted)
+	}
+	fingerprints, err := ad.Storage.Interactions(versionKey(sessionName, version))
+	if err != nil {
+		panic(err)
+	}
+	if len(fingerprints) != 1 || fingerprints[0] != manifest(1).Interactions[0].Fingerprint() {
+		t.Errorf("Expected accepted interaction to keep matched fingerprint but got %v", fingerprints)
+	}
+
+	session, err = ad.Show(sessionName)
+	if err != nil {
+		panic(err)
+	}
+	differences, err := ad.Compare(session, manifest(3))
+	if err != nil {
+		panic(err)
+	}
+	if result, found := differences[0]; !found || result.Changed {
+		t.Errorf("Expected accepted difference not to be reported again but got %v", differences)
+	}
+}
+
+func TestRerecordSubset(t *testing.T) {
+	release := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, `{"path":%q,"release":%d}`, r.URL.Path, release)
+	}))
+	defer server.Close()
+
+	manifest := Manifest{
+		Interactions: []RequestInteraction{
+			{URL: server.URL + "/users", Method: "get", Name: "list-users"},
+			{URL: server.URL + "/posts", Method: "get", Name: "list-posts", Tags: []string{"blog"}},
+			{URL: server.URL + "/comments", Method: "get", Tags: []string{"blog"}},
+		},
+	}
+
+	ad := NewWithStorage("", NewMemoryStorage(), Options{})
+	if _, err := ad.RecordVersion(sessionName, manifest); err != nil {
+		panic(err)
+	}
+
+	release = 2
+	version, recorded, err := ad.Rerecord(sessionName, manifest, InteractionFilter{
+		Only: regexp.MustCompile("^list-"),
+		Tags: []string{"blog"},
+	})
+	if err != nil {
+		panic(err)
+	}
+	if version != 2 || len(recorded) != 1 || recorded[0] != 1 {
+		t.Errorf("Expected interaction 1 re-recorded as version 2 but got %v as version %d", recorded, version)
+	}
+
+	expected := []string{`"release":1`, `"release":2`, `"release":1`}
+	for i, interaction := range manifest.Interactions {
+		stored, err := ad.Storage.LoadInteraction(versionKey(sessionName, version), interaction.Fingerprint())
+		if err != nil {
+			panic(err)
+		}
+		if !strings.Contains(stored.Interaction().Response.Body, expected[i]) {
+			t.Errorf("Expected interaction %d to contain %s but got %s", i, expected[i], stored.Interaction().Response.Body)
+		}
+	}
+
+	// failed recording must not create a version
+	manifest.Interactions[2].URL = "http://127.0.0.1:1/comments"
+	if _, _, err = ad.Rerecord(sessionName, manifest, InteractionFilter{Indexes: []int{0, 2}}); err == nil {
+		t.Error("Expected re-recording of unreachable interaction to fail")
+	}
+	versions, current, err := ad.History(sessionName)
+	if err != nil {
+		panic(err)
+	}
+	if len(versions) != 2 || current != 2 {
+		t.Errorf("Expected session to stay at version 2 but got %d versions with baseline %d", len(versions), current)
+	}
+
+	if _, _, err = ad.Rerecord(sessionName, manifest, InteractionFilter{Tags: []string{"missing"}}); err == nil {
+		t.Error("Expected filter without matching interactions to fail")
+	}
+}
+
+func TestTagSelection(t *testing.T) {
+	server := newTestAPI()
+	defer server.Close()
+
+	manifest := Manifest{
+		Interactions: []RequestInteraction{
+			{URL: server.URL + "/health", Method: "get", Tags: []string{"smoke"}},
+			{URL: server.URL + "/users", Method: "get", Tags: []string{"smoke", "admin"}},
+			{URL: server.URL + "/reports", Method: "get", Tags: []string{"slow"}},
+		},
+	}
+
+	storage := NewMemoryStorage()
+	ad := NewWithStorage("", storage, Options{
+		Selection: TagSelection{Tags: []string{"smoke"}},
+	})
+	if _, err := ad.RecordVersion(sessionName, manifest); err != nil {
+		panic(err)
+	}
+
+	all := NewWithStorage("", storage, Options{})
+	session, err := all.Show(sessionName)
+	if err != nil {
+		panic(err)
+	}
+	if len(session.Interactions) != 2 {
+		t.Errorf("Expected 2 selected interactions to be recorded but got %d", len(session.Interactions))
+	}
+	if session.Selection == nil || !reflect.DeepEqual(session.Selection.Tags, []string{"smoke"}) {
+		t.Errorf("Expected selection to be stored in session metadata but got %+v", session.Selection)
+	}
+
+	// interactions outside of partial baseline are not compared
+	differences, err := all.Compare(session, manifest)
+	if err != nil {
+		panic(err)
+	}
+	if len(differences) != 2 {
+		t.Errorf("Expected 2 compared interactions but got %d", len(differences))
+	}
+
+	nonAdmin := NewWithStorage("", storage, Options{
+		Selection: TagSelection{ExcludeTags: []string{"admin"}},
+	})
+	session, err = nonAdmin.Show(sessionName)
+	if err != nil {
+		panic(err)
+	}
+	if len(session.Interactions) != 1 || session.Interactions[0].URL != server.URL+"/health" {
+		t.Errorf("Expected only /health to be shown but got %+v", session.Interactions)
+	}
+	handler, err := nonAdmin.NewReplayHandler(sessionName, nil, ServeOptions{})
+	if err != nil {
+		panic(err)
+	}
+	if len(handler.interactions) != 1 {
+		t.Errorf("Expected 1 interaction to be served but got %d", len(handler.interactions))
+	}
+
+	var archive bytes.Buffer
+	if err = all.ExportSession(sessionName, &archive); err != nil {
+		panic(err)
+	}
+	imported, err := nonAdmin.ImportSession(&archive, "bar", false)
+	if err != nil {
+		panic(err)
+	}
+	if imported.Selection == nil || len(imported.Interactions) != 1 {
+		t.Errorf("Expected imported session to keep selection and tags but got %+v", imported)
+	}
+}
+
+func TestInteractionMatchingRules(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Etag", strconv.Itoa(requests))
+		fmt.Fprintf(w, `{"path":%q}`, r.URL.Path)
+	}))
+	defer server.Close()
+
+	manifest := NewManifest()
+	err := manifest.Parse(strings.NewReader(fmt.Sprintf(`
+matching_rules:
+  - name: ignore_headers
+    value: [Date]
+request:
+  headers:
+    X-Trace: ["1"]
+interactions:
+  - url: "%[1]s/generated"
+    method: get
+    matching_rules:
+      - name: ignore_headers
+        value: [Date, Etag, X-Trace]
+  - url: "%[1]s/stable"
+    method: get
+`, server.URL)))
+	if err != nil {
+		panic(err)
+	}
+
+	ad := NewWithStorage("", NewMemoryStorage(), Options{})
+	if _, err = ad.RecordVersion(sessionName, *manifest); err != nil {
+		panic(err)
+	}
+
+	key := versionKey(sessionName, 1)
+	for i, expected := range []bool{false, true} {
+		stored, err := ad.Storage.LoadInteraction(key, manifest.Interactions[i].Fingerprint())
+		if err != nil {
+			panic(err)
+		}
+		if _, found := stored.Interaction().Request.Headers["X-Trace"]; found != expected {
+			t.Errorf("Expected X-Trace header of interaction %d to be recorded %v but got %v", i, expected, found)
+		}
+	}
+
+	session, err := ad.Show(sessionName)
+	if err != nil {
+		panic(err)
+	}
+	differences, err := ad.Compare(session, *manifest)
+	if err != nil {
+		panic(err)
+	}
+	if differences[0].Changed {
+		t.Errorf("Expected Etag of interaction 0 to be ignored but got %v", differences[0].Headers)
+	}
+	if !differences[1].Changed {
+		t.Error("Expected Etag of interaction 1 to differ")
+	}
+}
+
+func TestRequestMatcher(t *testing.T) {
+	api := newTestAPI()
+	defer api.Close()
+
+	ad := NewWithStorage("", NewMemoryStorage(), Options{})
+	interaction := RequestInteraction{
+		URL:     api.URL + "/search?q=apidiff&page=1&ts=100",
+		Method:  "post",
+		Payload: `{"filter":{"tags":["a","b"]},"limit":10}`,
+	}
+	if err := ad.Record("", sessionName, interaction, RequestInfo{}, nil); err != nil {
+		panic(err)
+	}
+
+	rules := []MatchingRules{{Name: "match", Value: map[interface{}]interface{}{
+		"method":       true,
+		"path":         true,
+		"query":        true,
+		"ignore_query": []interface{}{"ts"},
+		"body":         "json",
+	}}}
+	handler, err := ad.NewReplayHandler(sessionName, rules, ServeOptions{})
+	if err != nil {
+		panic(err)
+	}
+
+	requests := []struct {
+		method, target, body string
+		status               int
+	}{
+		{"POST", "/search?page=1&ts=200&q=apidiff", `{"limit":10, "filter":{"tags":["a","b"]}}`, http.StatusOK},
+		{"POST", "/search?page=2&q=apidiff", `{"limit":10,"filter":{"tags":["a","b"]}}`, http.StatusNotFound},
+		{"POST", "/search?page=1&q=apidiff", `{"limit":10,"filter":{"tags":["b","a"]}}`, http.StatusNotFound},
+		{"GET", "/search?page=1&q=apidiff", `{"limit":10,"filter":{"tags":["a","b"]}}`, http.StatusNotFound},
+	}
+	for _, req := range requests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(req.method, req.target, strings.NewReader(req.body)))
+		if w.Code != req.status {
+			t.Errorf("Expected %s %s to return %d but got %d", req.method, req.target, req.status, w.Code)
+		}
+	}
+
+	// match_url compares method and URL with query in any order
+	handler, err = ad.NewReplayHandler(sessionName, []MatchingRules{{Name: "match_url", Value: true}}, ServeOptions{})
+	if err != nil {
+		panic(err)
+	}
+	for target, status := range map[string]int{
+		"/search?ts=100&page=1&q=apidiff": http.StatusOK,
+		"/search?ts=200&page=1&q=apidiff": http.StatusNotFound,
+		"/other?ts=100&page=1&q=apidiff":  http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", target, nil))
+		if w.Code != status {
+			t.Errorf("Expected POST %s to return %d with match_url but got %d", target, status, w.Code)
+		}
+	}
+
+	invalid := []MatchingRules{{Name: "match", Value: map[interface{}]interface{}{"body": "xml"}}}
+	if _, err = ad.NewReplayHandler(sessionName, invalid, ServeOptions{}); err == nil {
+		t.Error("Expected unknown body matching to be rejected")
+	}
+}
+
+func TestRequestMatcherCompare(t *testing.T) {
+	api := newTestAPI()
+	defer api.Close()
+
+	parse := func(query string, rules string) Manifest {
+		manifest := NewManifest()
+		err := manifest.Parse(strings.NewReader(fmt.Sprintf(`
+interactions:
+  - url: "%s/search?%s"
+    method: get
+%s`, api.URL, query, rules)))
+		if err != nil {
+			panic(err)
+		}
+		return *manifest
+	}
+
+	ad := NewWithStorage("", NewMemoryStorage(), Options{})
+	if _, err := ad.RecordVersion(sessionName, parse("q=apidiff&ts=100", "")); err != nil {
+		panic(err)
+	}
+	session, err := ad.Show(sessionName)
+	if err != nil {
+		panic(err)
+	}
+
+	// changed query changes fingerprint so the interaction is not compared
+	differences, err := ad.Compare(session, parse("ts=200&q=apidiff", ""))
+	if err != nil {
+		panic(err)
+	}
+	if len(differences) != 0 {
+		t.Errorf("Expected no compared interaction without matcher but got %d", len(differences))
+	}
+
+	// matcher pairs interactions with different fingerprints
+	matcher := `matching_rules:
+  - name: ignore_headers
+    value: [Date]
+  - name: match
+    value: {method: true, path: true, query: true, ignore_query: [ts]}
+`
+	differences, err = ad.Compare(session, parse("ts=200&q=apidiff", matcher))
+	if err != nil {
+		panic(err)
+	}
+	if result, found := differences[0]; !found || result.Changed {
+		t.Errorf("Expected interaction to be paired by matcher without differences but got %v", differences)
+	}
+
+	differences, err = ad.Compare(session, parse("ts=200&q=other", matcher))
+	if err != nil {
+		panic(err)
+	}
+	if len(differences) != 0 {
+		t.Errorf("Expected unmatched interaction not to be compared but got %v", differences)
+	}
+
+	// interaction compared by fingerprint is not paired again
+	both := parse("ts=200&q=apidiff", matcher)
+	both.Interactions = append(both.Interactions, parse("q=apidiff&ts=100", "").Interactions...)
+	differences, err = ad.Compare(session, both)
+	if err != nil {
+		panic(err)
+	}
+	if _, found := differences[1]; !found || len(differences) != 1 {
+		t.Errorf("Expected only interaction 1 to be compared but got %v", differences)
+	}
+
+	// recorded requests are loaded once per comparison
+	counting := &countingStorage{Storage: NewMemoryStorage()}
+	ad = NewWithStorage("", counting, Options{})
+	recorded, changed := NewManifest(), NewManifest()
+	for i := 0; i < 5; i++ {
+		recorded.Interactions = append(recorded.Interactions, parse(fmt.Sprintf("q=%d&ts=1", i), "").Interactions...)
+		changed.Interactions = append(changed.Interactions, parse(fmt.Sprintf("q=%d&ts=2", i), "").Interactions...)
+	}
+	changed.MatchingRules = parse("", matcher).MatchingRules
+	if _, err = ad.RecordVersion(sessionName, *recorded); err != nil {
+		panic(err)
+	}
+	if session, err = ad.Show(sessionName); err != nil {
+		panic(err)
+	}
+	counting.loads = 0
+	differences, err = ad.Compare(session, *changed)
+	if err != nil {
+		panic(err)
+	}
+	if len(differences) != 5 || counting.loads > 10 {
+		t.Errorf("Expected 5 compared interactions with at most 10 loads but got %d with %d", len(differences), counting.loads)
+	}
+}
+
+// countingStorage counts loaded interactions
+type countingStorage struct {
+	Storage
+	loads int
+}
+
+func (cs *countingStorage) LoadInteraction(session, fingerprint string) (*StoredInteraction, error) {
+	cs.loads++
+	return cs.Storage.LoadInteraction(session, fingerprint)
+}
+
+func TestRedaction(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: strconv.Itoa(requests), Path: "/"})
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, `{"user":{"name":"joe","access_token":"t%d","ssn":"123"},"card":"card=4242"}`, requests)
+	}))
+	defer server.Close()
+
+	manifest := NewManifest()
+	err := manifest.Parse(strings.NewReader(fmt.Sprintf(`
+matching_rules:
+  - name: redact
+    value:
+      query: [sig]
+      json: [user.ssn]
+      patterns: ['card=(\d+)']
+request:
+  headers:
+    Authorization: ["Bearer secret"]
+    Content-Type: [application/json]
+interactions:
+  - url: "%[1]s/login?sig=abc&page=1&api_key=k"
+    method: post
+    body: '{"login":"joe","password":"hunter2"}'
+`, server.URL)))
+	if err != nil {
+		panic(err)
+	}
+
+	ad := NewWithStorage("", NewMemoryStorage(), Options{})
+	if _, err = ad.RecordVersion(sessionName, *manifest); err != nil {
+		panic(err)
+	}
+
+	stored, err := ad.Storage.LoadInteraction(versionKey(sessionName, 1), manifest.Interactions[0].Fingerprint())
+	if err != nil {
+		panic(err)
+	}
+	ci := stored.Interaction()
+
+	expected := map[string]string{
+		"URL":           server.URL + "/login?api_key=%5BREDACTED%5D&page=1&sig=%5BREDACTED%5D",
+		"Authorization": "Bearer [REDACTED]",
+		"request body":  `{"login":"joe","password":"[REDACTED]"}`,
+		"Set-Cookie":    "session=[REDACTED]; Path=/",
+		"response body": `{"card":"card=[REDACTED]","user":{"access_token":"[REDACTED]","name":"joe","ssn":"[REDACTED]"}}`,
+		"Content-Type":  "application/json; charset=utf-8",
+	}
+	actual := map[string]string{
+		"URL":           ci.Request.URL,
+		"Authorization": ci.Request.Headers.Get("Authorization"),
+		"request body":  ci.Request.Body,
+		"Set-Cookie":    ci.Response.Headers.Get("Set-Cookie"),
+		"response body": ci.Response.Body,
+		"Content-Type":  ci.Response.Headers.Get("Content-Type"),
+	}
+	for key, value := range expected {
+		if actual[key] != value {
+			t.Errorf("Expected stored %s to be %q but got %q", key, value, actual[key])
+		}
+	}
+
+	// placeholder is stable so changed secrets are not differences
+	session, err := ad.Show(sessionName)
+	if err != nil {
+		panic(err)
+	}
+	differences, err := ad.Compare(session, *manifest)
+	if err != nil {
+		panic(err)
+	}
+	if differences[0].Changed {
+		t.Errorf("Expected redacted values not to differ but got %v %v", differences[0].Headers, differences[0].Body)
+	}
+
+	// defaults can be disabled
+	rules := []MatchingRules{{Name: "redact", Value: map[interface{}]interface{}{"defaults": false, "headers": []interface{}{"X-Trace"}}}}
+	interaction := RequestInteraction{URL: server.URL + "/other", Method: "get"}
+	info := RequestInfo{Headers: http.Header{"Authorization": {"Bearer secret"}, "X-Trace": {"1"}}}
+	if err = ad.Record("", "plain", interaction, info, rules); err != nil {
+		panic(err)
+	}
+	key, err := ad.recordingKey("plain")
+	if err != nil {
+		panic(err)
+	}
+	stored, err = ad.Storage.LoadInteraction(key, interaction.Fingerprint())
+	if err != nil {
+		panic(err)
+	}
+	headers := stored.Interaction().Request.Headers
+	if headers.Get("Authorization") != "Bearer secret" || headers.Get("X-Trace") != RedactedPlaceholder {
+		t.Errorf("Expected only X-Trace to be redacted but got %v", headers)
+	}
+
+	invalid := []MatchingRules{{Name: "redact", Value: map[interface{}]interface{}{"json": []interface{}{"user..ssn"}}}}
+	if err = ad.Record("", "plain", interaction, info, invalid); err == nil {
+		t.Error("Expected invalid JSON path to be rejected")
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	tokens := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "client" || secret != "s3cret" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client"}`)
+			return
+		}
+		tokens++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":3600}`, tokens)
+	}))
+	defer tokenServer.Close()
+
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("Authorization")+r.Header.Get("X-Key")+r.URL.Query().Get("key"))
+		fmt.Fprint(w, "{}")
+	}))
+	defer server.Close()
+
+	os.Setenv("APIDIFF_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("APIDIFF_TEST_SECRET")
+
+	auths := map[string]struct {
+		auth     string
+		received string
+		header   string
+		url      string
+	}{
+		"basic": {
+			"basic: {username: joe, password_env: APIDIFF_TEST_SECRET}",
+			"Basic am9lOnMzY3JldA==", "Basic [REDACTED]", "/basic",
+		},
+		"bearer": {
+			"bearer: {token_env: APIDIFF_TEST_SECRET}",
+			"Bearer s3cret", "Bearer [REDACTED]", "/bearer",
+		},
+		"header": {
+			"api_key: {name: X-Key, value_env: APIDIFF_TEST_SECRET}",
+			"s3cret", "", "/header",
+		},
+		"query": {
+			"api_key: {name: key, in: query, value_env: APIDIFF_TEST_SECRET}",
+			"s3cret", "", "/query?key=%5BREDACTED%5D",
+		},
+		"oauth2": {
+			fmt.Sprintf("oauth2: {token_url: %q, client_id: client, client_secret_env: APIDIFF_TEST_SECRET}", tokenServer.URL),
+			"Bearer token-1", "Bearer [REDACTED]", "/oauth2",
+		},
+	}
+	for name, expected := range auths {
+		received = nil
+		manifest := NewManifest()
+		err := manifest.Parse(strings.NewReader(fmt.Sprintf(`
+matching_rules:
+  - name: redact
+    value: {defaults: false}
+auth:
+  %s
+interactions:
+  - url: "%s/%s"
+    method: get
+  - url: "%[2]s/%[3]s"
+    method: post
+`, expected.auth, server.URL, name)))
+		if err != nil {
+			panic(err)
+		}
+
+		ad := NewWithStorage("", NewMemoryStorage(), Options{})
+		if _, err = ad.RecordVersion(sessionName, *manifest); err != nil {
+			panic(err)
+		}
+
+		if len(received) != 2 || received[0] != expected.received || received[1] != expected.received {
+			t.Errorf("Expected %s credentials %q to be sent but got %v", name, expected.received, received)
+		}
+
+		stored, err := ad.Storage.LoadInteraction(versionKey(sessionName, 1), manifest.Interactions[0].Fingerprint())
+		if err != nil {
+			panic(err)
+		}
+		request := stored.Interaction().Request
+		if header := request.Headers.Get("Authorization"); header != expected.header {
+			t.Errorf("Expected stored %s Authorization header %q but got %q", name, expected.header, header)
+		}
+		if value := request.Headers.Get("X-Key"); value != "" && value != RedactedPlaceholder {
+			t.Errorf("Expected stored %s API key header to be redacted but got %q", name, value)
+		}
+		if !strings.HasSuffix(request.URL, expected.url) {
+			t.Errorf("Expected stored %s URL to end with %q but got %q", name, expected.url, request.URL)
+		}
+	}
+
+	if tokens != 1 {
+		t.Errorf("Expected oauth2 token to be obtained once but got %d", tokens)
+	}
+
+	// expired token is obtained again
+	oauth2Tokens.Lock()
+	for key, token := range oauth2Tokens.tokens {
+		token.expires = time.Now().Add(-time.Second)
+		oauth2Tokens.tokens[key] = token
+	}
+	oauth2Tokens.Unlock()
+
+	oauth2 := &Auth{OAuth2: &OAuth2Auth{TokenURL: tokenServer.URL, ClientID: "client", ClientSecretEnv: "APIDIFF_TEST_SECRET"}}
+	req := httptest.NewRequest("GET", server.URL, nil)
+	if err := oauth2.authenticate(req); err != nil {
+		panic(err)
+	}
+	if header := req.Header.Get("Authorization"); header != "Bearer token-2" {
+		t.Errorf("Expected expired token to be refreshed but got %q", header)
+	}
+
+	os.Unsetenv("APIDIFF_TEST_SECRET")
+	bearer := &Auth{Bearer: &BearerAuth{TokenEnv: "APIDIFF_TEST_SECRET"}}
+	if err := bearer.authenticate(req); err == nil {
+		t.Error("Expected missing environment variable to be reported")
+	}
+
+	manifest := NewManifest()
+	err := manifest.Parse(strings.NewReader(`
+auth:
+  bearer: {token_env: TOKEN}
+  basic: {username: joe, password_env: PASSWORD}
+interactions: []
+`))
+	if err == nil {
+		t.Error("Expected auth with two methods to be rejected")
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+	logins, logouts := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			logins++
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: strconv.Itoa(logins), Path: "/"})
+			fmt.Fprint(w, `{"logged":true}`)
+		case "/logout":
+			logouts++
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "", Path: "/", MaxAge: -1})
+			fmt.Fprint(w, `{"logged":false}`)
+		default:
+			if _, err := r.Cookie("session"); err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, `{"error":"unauthorized"}`)
+				return
+			}
+			fmt.Fprint(w, `{"user":"joe"}`)
+		}
+	}))
+	defer server.Close()
+
+	for _, cookies := range []bool{true, false} {
+		manifest := NewManifest()
+		err := manifest.Parse(strings.NewReader(fmt.Sprintf(`
+cookies: %v
+matching_rules:
+  - name: ignore_headers
+    value: [Date]
+interactions:
+  - url: "%[2]s/login"
+    method: post
+    tags: [auth]
+  - url: "%[2]s/me"
+    method: get
+    tags: [browse]
+  - url: "%[2]s/logout"
+    method: post
+    tags: [auth]
+`, cookies, server.URL)))
+		if err != nil {
+			panic(err)
+		}
+
+		ad := NewWithStorage("", NewMemoryStorage(), Options{})
+		if _, err = ad.RecordVersion(sessionName, *manifest); err != nil {
+			panic(err)
+		}
+
+		session, err := ad.Show(sessionName)
+		if err != nil {
+			panic(err)
+		}
+		expected := http.StatusUnauthorized
+		if cookies {
+			expected = http.StatusOK
+		}
+		for _, interaction := range session.Interactions {
+			if interaction.Method == "GET" && interaction.StatusCode != expected {
+				t.Errorf("Expected status %d with cookies %v but got %d", expected, cookies, interaction.StatusCode)
+			}
+		}
+
+		// target is recorded with its own jar
+		differences, err := ad.Compare(session, *manifest)
+		if err != nil {
+			panic(err)
+		}
+		for i, difference := range differences {
+			if difference.Changed {
+				t.Errorf("Expected interaction %d not to differ with cookies %v but got %v", i, cookies, difference.Headers)
+			}
+		}
+
+		if !cookies {
+			continue
+		}
+		stored, err := ad.Storage.LoadInteraction(versionKey(sessionName, 1), manifest.Interactions[1].Fingerprint())
+		if err != nil {
+			panic(err)
+		}
+		stats := RequestStats{}
+		var buf bytes.Buffer
+		NewUI(&buf).ShowInteractionDetail(stored.Interaction(), &stats)
+		if !strings.Contains(buf.String(), "session=[REDACTED]") {
+			t.Errorf("Expected detail to show sent cookies but got %s", buf.String())
+		}
+
+		// subsets replay interactions setting cookies without storing them,
+		// the ones following selected interactions are not replayed
+		logouts = 0
+		version, _, err := ad.Rerecord(sessionName, *manifest, InteractionFilter{Tags: []string{"browse"}})
+		if err != nil {
+			panic(err)
+		}
+		rerecorded, err := ad.ShowVersion(sessionName, version)
+		if err != nil {
+			panic(err)
+		}
+		for _, interaction := range rerecorded.Interactions {
+			if interaction.Method == "GET" && interaction.StatusCode != http.StatusOK {
+				t.Errorf("Expected re-recorded interaction to be sent with cookies but got %d", interaction.StatusCode)
+			}
+		}
+
+		ad.Options.Selection = TagSelection{Tags: []string{"browse"}}
+		differences, err = ad.Compare(session, *manifest)
+		if err != nil {
+			panic(err)
+		}
+		browse, found := differences[1]
+		if _, skipped := differences[0]; skipped || !found || browse.Changed {
+			t.Errorf("Expected selected interaction to be compared with cookies but got %v", differences)
+		}
+		if logouts != 0 {
+			t.Errorf("Expected interactions after selected ones not to be replayed but got %d logouts", logouts)
+		}
+	}
+}
+
+func TestStructuredRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"query":%q}`, r.URL.RawQuery)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "apidifftest")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"fixtures/user.json":  `{"name":"joe"}`,
+		"fixtures/avatar.png": "png",
+		"manifest.yaml": fmt.Sprintf(`
+version: 1
+request:
+  headers:
+    Content-Type: [application/json]
+interactions:
+  - url: "%[1]s/search?q=apidiff"
+    method: get
+    query:
+      page: 2
+      tags: [a, b]
+  - url: "%[1]s/login"
+    method: post
+    form:
+      user: joe
+  - url: "%[1]s/avatar"
+    method: post
+    multipart:
+      fields:
+        user: joe
+      files:
+        avatar: fixtures/avatar.png
+  - url: "%[1]s/users"
+    method: post
+    body_file: fixtures/user.json
+`, server.URL),
+	}
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			panic(err)
+		}
+		if err = ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			panic(err)
+		}
+	}
+
+	manifest := NewManifest()
+	if err = manifest.ParseFile(filepath.Join(dir, "manifest.yaml")); err != nil {
+		panic(err)
+	}
+
+	ad := NewWithStorage("", NewMemoryStorage(), Options{})
+	if _, err = ad.RecordVersion(sessionName, *manifest); err != nil {
+		panic(err)
+	}
+
+	expected := []struct {
+		url, contentType, body string
+	}{
+		{server.URL + "/search?page=2&q=apidiff&tags=a&tags=b", "application/json", ""},
+		{server.URL + "/login", "application/x-www-form-urlencoded", "user=joe"},
+		{server.URL + "/avatar", "multipart/form-data; boundary=" + multipartBoundary, "png"},
+		{server.URL + "/users", "application/json", `{"name":"joe"}`},
+	}
+	for i, e := range expected {
+		stored, err := ad.Storage.LoadInteraction(versionKey(sessionName, 1), manifest.Interactions[i].Fingerprint())
+		if err != nil {
+			panic(err)
+		}
+		request := stored.Interaction().Request
+		if request.URL != e.url {
+			t.Errorf("Expected interaction %d URL %q but got %q", i, e.url, request.URL)
+		}
+		if contentType := request.Headers.Get("Content-Type"); contentType != e.contentType {
+			t.Errorf("Expected interaction %d content type %q but got %q", i, e.contentType, contentType)
+		}
+		if !strings.Contains(request.Body, e.body) {
+			t.Errorf("Expected interaction %d body to contain %q but got %q", i, e.body, request.Body)
+		}
+	}
+
+	// query is part of URL in fingerprint
+	inline := RequestInteraction{URL: server.URL + "/search?q=apidiff&page=2&tags=a&tags=b", Method: "get"}
+	if inline.Fingerprint() != manifest.Interactions[0].Fingerprint() {
+		t.Error("Expected query parameters to match the same query in URL")
+	}
+	form := manifest.Interactions[1]
+	form.Form = Values{"user": {"jane"}}
+	if form.Fingerprint() == manifest.Interactions[1].Fingerprint() {
+		t.Error("Expected form fields to change fingerprint")
+	}
+
+	err = NewManifest().Parse(strings.NewReader(`
+interactions:
+  - url: "http://localhost/login"
+    method: post
+    body: "user=joe"
+    form:
+      user: joe
+`))
+	if err == nil || !strings.Contains(err.Error(), "only one of body, form") {
+		t.Errorf("Expected conflicting bodies to be rejected but got %v", err)
+	}
+
+	if err = os.Remove(filepath.Join(dir, "fixtures/user.json")); err != nil {
+		panic(err)
+	}
+	issues, err := ad.Lint(filepath.Join(dir, "manifest.yaml"))
+	if err != nil {
+		panic(err)
+	}
+	if len(issues) != 1 || issues[0].Line != 25 || issues[0].Message != `unable to read "fixtures/user.json"` {
+		t.Errorf("Expected missing body file to be reported but got %v", issues)
+	}
+}
+
+func TestJSONBodies(t *testing.T) {
+	api := newTestAPI()
+	defer api.Close()
+
+	manifest := NewManifest()
+	err := manifest.Parse(strings.NewReader(fmt.Sprintf(`
+request:
+  json:
+    client: {id: 1, name: apidiff}
+    limit: 10
+interactions:
+  - url: "%[1]s/merged"
+    method: post
+    json:
+      client: {name: "<joe>"}
+      tags: [a, b]
+  - url: "%[1]s/shared"
+    method: post
+  - url: "%[1]s/raw"
+    method: post
+    body: "raw"
+`, api.URL)))
+	if err != nil {
+		panic(err)
+	}
+
+	ad := NewWithStorage("", NewMemoryStorage(), Options{})
+	if _, err = ad.RecordVersion(sessionName, *manifest); err != nil {
+		panic(err)
+	}
+
+	expected := []struct {
+		body, contentType string
+	}{
+		{`{"client":{"id":1,"name":"<joe>"},"limit":10,"tags":["a","b"]}`, "application/json"},
+		{`{"client":{"id":1,"name":"apidiff"},"limit":10}`, "application/json"},
+		{"raw", ""},
+	}
+	for i, e := range expected {
+		stored, err := ad.Storage.LoadInteraction(versionKey(sessionName, 1), manifest.Interactions[i].Fingerprint())
+		if err != nil {
+			panic(err)
+		}
+		request := stored.Interaction().Request
+		if request.Body != e.body {
+			t.Errorf("Expected interaction %d body %s but got %s", i, e.body, request.Body)
+		}
+		if contentType := request.Headers.Get("Content-Type"); contentType != e.contentType {
+			t.Errorf("Expected interaction %d content type %q but got %q", i, e.contentType, contentType)
+		}
+	}
+
+	// JSON documents are part of fingerprint regardless of key order
+	a := RequestInteraction{URL: api.URL, Method: "post", JSON: map[interface{}]interface{}{"a": 1, "b": 2}}
+	b := RequestInteraction{URL: api.URL, Method: "post", JSON: map[interface{}]interface{}{"b": 2, "a": 1}}
+	c := RequestInteraction{URL: api.URL, Method: "post", JSON: map[interface{}]interface{}{"a": 2, "b": 2}}
+	if a.Fingerprint() != b.Fingerprint() || a.Fingerprint() == c.Fingerprint() {
+		t.Error("Expected fingerprint to depend on JSON document only")
+	}
+	a.fingerprint = &FingerprintOptions{BodyJSON: []string{"b"}}
+	c.fingerprint = a.fingerprint
+	if a.Fingerprint() != c.Fingerprint() {
+		t.Error("Expected body_json fingerprint to select JSON document values")
+	}
+
+	err = NewManifest().Parse(strings.NewReader(`
+request:
+  body: "{}"
+  json: {a: 1}
+interactions: []
+`))
+	if err == nil {
+		t.Error("Expected shared body and json to be rejected")
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	newServer := func(location string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/old":
+				http.Redirect(w, r, "/older", http.StatusMovedPermanently)
+			case "/older":
+				http.Redirect(w, r, location, http.StatusFound)
+			default:
+				fmt.Fprint(w, `{"id":1}`)
+			}
+		}))
+	}
+	source := newServer("/new")
+	defer source.Close()
+	target := newServer("/newer")
+	defer target.Close()
+
+	parse := func(server *httptest.Server, redirects string) *Manifest {
+		manifest := NewManifest()
+		err := manifest.Parse(strings.NewReader(fmt.Sprintf(`
+%s
+fingerprint: {method: true, path: true}
+matching_rules:
+  - name: ignore_headers
+    value: [Date]
+interactions:
+  - url: "%s/old"
+    method: get
+`, redirects, server.URL)))
+		if err != nil {
+			panic(err)
+		}
+		return manifest
+	}
+
+	policies := map[string]struct {
+		exchanges int
+		status    int
+	}{
+		"":                                     {3, http.StatusOK},
+		"redirects: {follow: false}":           {1, http.StatusMovedPermanently},
+		"redirects: {max: 1}":                  {2, http.StatusFound},
+		"redirects: {follow: true, max: 2}":    {3, http.StatusOK},
+		"redirects: {follow: true, max: 1000}": {3, http.StatusOK},
+	}
+	for redirects, expected := range policies {
+		ad := NewWithStorage("", NewMemoryStorage(), Options{})
+		manifest := parse(source, redirects)
+		if _, err := ad.RecordVersion(sessionName, *manifest); err != nil {
+			panic(err)
+		}
+
+		stored, err := ad.Storage.LoadInteraction(versionKey(sessionName, 1), manifest.Interactions[0].Fingerprint())
+		if err != nil {
+			panic(err)
+		}
+		if len(stored.Interactions) != expected.exchanges || stored.Final().Response.Code != expected.status {
+			t.Errorf("Expected %d exchanges ending with %d for %q but got %d ending with %d",
+				expected.exchanges, expected.status, redirects, len(stored.Interactions), stored.Final().Response.Code)
+		}
+	}
+
+	// changed location of the second redirect is reported
+	ad := NewWithStorage("", NewMemoryStorage(), Options{})
+	if _, err := ad.RecordVersion(sessionName, *parse(source, "")); err != nil {
+		panic(err)
+	}
+	session, err := ad.Show(sessionName)
+	if err != nil {
+		panic(err)
+	}
+	differences, err := ad.Compare(session, *parse(target, ""))
+	if err != nil {
+		panic(err)
+	}
+	expected := map[string]string{"2": "expect 302 /new but got 302 /newer"}
+	if !differences[0].Changed || len(differences[0].Redirects) != 1 || differences[0].Redirects["2"].Error() != expected["2"] {
+		t.Errorf("Expected redirect differences %v but got %v", expected, differences[0].Redirects)
+	}
+	if len(differences[0].Headers) != 0 || len(differences[0].Body) != 0 {
+		t.Errorf("Expected final responses to be equal but got %v %v", differences[0].Headers, differences[0].Body)
+	}
+
+	// the same chain on another host does not differ
+	other := newServer("/new")
+	defer other.Close()
+	differences, err = ad.Compare(session, *parse(other, ""))
+	if err != nil {
+		panic(err)
+	}
+	if differences[0].Changed {
+		t.Errorf("Expected equal redirect chains not to differ but got %v", differences[0].Redirects)
+	}
+
+	// extra hop is reported
+	differences, err = ad.Compare(session, *parse(target, "redirects: {max: 1}"))
+	if err != nil {
+		panic(err)
+	}
+	if err := differences[0].Redirects["2"]; err == nil || err.Error() != "redirect 302 /new is missing" {
+		t.Errorf("Expected missing redirect to be reported but got %v", differences[0].Redirects)
+	}
+
+	// followed redirects are replayed
+	handler, err := ad.NewReplayHandler(sessionName, nil, ServeOptions{})
+	if err != nil {
+		panic(err)
+	}
+	for target, status := range map[string]int{"/old": 301, "/older": 302, "/new": 200} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", source.URL+target, nil))
+		if w.Code != status {
+			t.Errorf("Expected replayed %s to return %d but got %d", target, status, w.Code)
+		}
+	}
+
+	// final response is shown and every exchange is exported
+	if session.Interactions[0].StatusCode != http.StatusOK {
+		t.Errorf("Expected final status to be shown but got %d", session.Interactions[0].StatusCode)
+	}
+	final, _, err := ad.Detail(sessionName, 1)
+	if err != nil {
+		panic(err)
+	}
+	if final.Response.Code != http.StatusOK {
+		t.Errorf("Expected detail of final response but got %d", final.Response.Code)
+	}
+	var buf bytes.Buffer
+	if err = ad.ExportHAR(sessionName, &buf); err != nil {
+		panic(err)
+	}
+	exported, err := ParseHAR(&buf)
+	if err != nil {
+		panic(err)
+	}
+	var codes []int
+	for _, entry := range exported.Log.Entries {
+		codes = append(codes, entry.Response.Status)
+	}
+	if !reflect.DeepEqual(codes, []int{301, 302, 200}) {
+		t.Errorf("Expected every exchange to be exported but got %v", codes)
+	}
+
+	// redirects are listed in their order
+	redirects := make(map[string]error)
+	for i := 1; i <= 11; i++ {
+		redirects[strconv.Itoa(i)] = fmt.Errorf("redirect %d", i)
+	}
+	buf.Reset()
+	NewUI(&buf).ShowComparisonResults(session, map[int]Differences{0: {Redirects: redirects, Changed: true}})
+	output := buf.String()
+	second, tenth := strings.Index(output, "Redirect 2 "), strings.Index(output, "Redirect 10 ")
+	if second < 0 || tenth < 0 || second > tenth {
+		t.Error("Expected redirects to be sorted numerically")
+	}
+
+	if err = NewManifest().Parse(strings.NewReader("redirects: {max: -1}\ninteractions: []\n")); err == nil {
+		t.Error("Expected negative max redirects to be rejected")
+	}
+}
+
+func newTestAPI() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, `{"id":1,"path":%q}`, r.URL.Path)
+	}))
 }
@@ -0,0 +1,544 @@
+package apidiff
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// largest archived file that is accepted, guards against archive bombs
+	maxArchiveFileSize = 64 << 20
+
+	// sessionIndexFile describes session bundled in portable archive
+	sessionIndexFile    = "session.yaml"
+	sessionIndexVersion = 1
+)
+
+// sessionIndex holds metadata of exported session together with
+// checksums of all bundled files
+type sessionIndex struct {
+	Version      int               `yaml:"version"`
+	Name         string            `yaml:"name"`
+	Created      time.Time         `yaml:"created"`
+	Exported     time.Time         `yaml:"exported"`
+	Fingerprints []string          `yaml:"fingerprints"`
+	Files        []sessionChecksum `yaml:"files"`
+	// Selection and Tags of exported session version
+	Selection *TagSelection       `yaml:"selection,omitempty"`
+	Tags      map[string][]string `yaml:"tags,omitempty"`
+}
+
+type sessionChecksum struct {
+	Name   string `yaml:"name"`
+	Size   int    `yaml:"size"`
+	SHA256 string `yaml:"sha256"`
+}
+
+// ArchiveStorage keeps all sessions in a single gzipped tar file so
+// they can be shipped as one artifact, every change rewrites the file
+type ArchiveStorage struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+type archiveFile struct {
+	Name     string
+	Data     []byte
+	Modified time.Time
+	Dir      bool
+}
+
+// NewArchiveStorage creates storage backed by a .tar.gz file which is
+// created on first write
+func NewArchiveStorage(path string) *ArchiveStorage {
+	return &ArchiveStorage{Path: path}
+}
+
+// IsArchivePath reports whether path names a gzipped tar archive
+func IsArchivePath(p string) bool {
+	return strings.HasSuffix(p, ".tar.gz") || strings.HasSuffix(p, ".tgz")
+}
+
+// Sessions implements Storage interface
+func (as *ArchiveStorage) Sessions() ([]RecordedSession, error) {
+	ms, err := as.load()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := ms.Sessions()
+	for i := range sessions {
+		sessions[i].Path = as.Path
+	}
+	return sessions, err
+}
+
+// Interactions implements Storage interface
+func (as *ArchiveStorage) Interactions(session string) ([]string, error) {
+	ms, err := as.load()
+	if err != nil {
+		return nil, err
+	}
+	return ms.Interactions(session)
+}
+
+// LoadInteraction implements Storage interface
+func (as *ArchiveStorage) LoadInteraction(session, fingerprint string) (*StoredInteraction, error) {
+	ms, err := as.load()
+	if err != nil {
+		return nil, err
+	}
+	return ms.LoadInteraction(session, fingerprint)
+}
+
+// LoadMetadata implements Storage interface
+func (as *ArchiveStorage) LoadMetadata(session string) (*SessionMetadata, error) {
+	ms, err := as.load()
+	if err != nil {
+		return nil, err
+	}
+	return ms.LoadMetadata(session)
+}
+
+// SaveMetadata implements Storage interface
+func (as *ArchiveStorage) SaveMetadata(session string, metadata *SessionMetadata) error {
+	return as.update(func(ms *MemoryStorage) error {
+		return ms.SaveMetadata(session, metadata)
+	})
+}
+
+// SaveInteraction implements Storage interface
+func (as *ArchiveStorage) SaveInteraction(session, fingerprint string, interaction *StoredInteraction) error {
+	return as.update(func(ms *MemoryStorage) error {
+		return ms.SaveInteraction(session, fingerprint, interaction)
+	})
+}
+
+// DeleteInteraction implements Storage interface
+func (as *ArchiveStorage) DeleteInteraction(session, fingerprint string) error {
+	return as.update(func(ms *MemoryStorage) error {
+		return ms.DeleteInteraction(session, fingerprint)
+	})
+}
+
+// DeleteSession implements Storage interface
+func (as *ArchiveStorage) DeleteSession(session string) error {
+	return as.update(func(ms *MemoryStorage) error {
+		return ms.DeleteSession(session)
+	})
+}
+
+// load reads whole archive into memory, missing archive is empty
+func (as *ArchiveStorage) load() (*MemoryStorage, error) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.read()
+}
+
+// update applies change to archive contents and writes them back
+func (as *ArchiveStorage) update(change func(ms *MemoryStorage) error) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	ms, err := as.read()
+	if err != nil {
+		return err
+	}
+	if err = change(ms); err != nil {
+		return err
+	}
+	return as.write(ms)
+}
+
+func (as *ArchiveStorage) read() (*MemoryStorage, error) {
+	ms := NewMemoryStorage()
+
+	f, err := os.Open(as.Path)
+	if os.IsNotExist(err) {
+		return ms, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	files, err := readArchive(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read archive %q - %s", as.Path, err)
+	}
+
+	for _, file := range files {
+		switch {
+		case file.Dir:
+			if _, found := ms.sessions[file.Name]; !found {
+				ms.sessions[file.Name] = &memorySession{
+					created: file.Modified,
+					files:   make(map[string]memoryFile),
+				}
+			}
+		case strings.Contains(file.Name, "/"):
+			ms.writeFile(path.Dir(file.Name), path.Base(file.Name), file.Data, file.Modified)
+		}
+	}
+	return ms, nil
+}
+
+func (as *ArchiveStorage) write(ms *MemoryStorage) error {
+	var files []archiveFile
+
+	ms.mu.RLock()
+	for name, session := range ms.sessions {
+		files = append(files, archiveFile{Name: name, Modified: session.created, Dir: true})
+		for fileName, file := range session.files {
+			files = append(files, archiveFile{
+				Name:     path.Join(name, fileName),
+				Data:     file.data,
+				Modified: file.modified,
+			})
+		}
+	}
+	ms.mu.RUnlock()
+
+	return writeFileAtomically(as.Path, func(w io.Writer) error {
+		return writeArchive(w, files)
+	})
+}
+
+// ExportSession writes recorded session with all its interactions and
+// stats as portable gzipped tar archive
+func (ad *APIDiff) ExportSession(name string, w io.Writer) error {
+	session, err := ad.Show(name)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := ad.metadata(name)
+	if err != nil {
+		return err
+	}
+
+	key := versionKey(name, session.Version)
+	fingerprints, err := ad.Storage.Interactions(key)
+	if err != nil {
+		return err
+	}
+
+	index := sessionIndex{
+		Version:      sessionIndexVersion,
+		Name:         name,
+		Created:      session.Created,
+		Exported:     time.Now(),
+		Fingerprints: fingerprints,
+		Selection:    session.Selection,
+		Tags:         metadata.version(session.Version).Tags,
+	}
+
+	var files []archiveFile
+	add := func(fileName string, data []byte, modified time.Time) {
+		sum := sha256.Sum256(data)
+		index.Files = append(index.Files, sessionChecksum{
+			Name:   fileName,
+			Size:   len(data),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+		files = append(files, archiveFile{Name: fileName, Data: data, Modified: modified})
+	}
+
+	for _, fingerprint := range fingerprints {
+		stored, err := ad.Storage.LoadInteraction(key, fingerprint)
+		if err != nil {
+			return err
+		}
+
+		data, err := encodeCassette(stored.Interactions)
+		if err != nil {
+			return err
+		}
+		add(path.Join("interactions", fingerprint+cassetteSuffix), data, stored.Recorded)
+
+		if stored.Stats != nil {
+			data, err = yaml.Marshal(stored.Stats)
+			if err != nil {
+				return err
+			}
+			add(path.Join("interactions", fingerprint+statsSuffix), data, stored.Recorded)
+		}
+	}
+
+	data, err := yaml.Marshal(index)
+	if err != nil {
+		return err
+	}
+	files = append(files, archiveFile{Name: sessionIndexFile, Data: data, Modified: index.Exported})
+
+	if ad.Options.Verbose {
+		fmt.Printf("Exporting %d interactions of session %q...\n", len(fingerprints), name)
+	}
+	return writeArchive(w, files)
+}
+
+// ImportSession verifies checksums of session archive and stores it
+// under its exported name or name when given. Existing session is
+// never overwritten, it is either refused or a free name is chosen
+// when rename is set
+func (ad *APIDiff) ImportSession(r io.Reader, name string, rename bool) (RecordedSession, error) {
+	files, err := readArchive(r)
+	if err != nil {
+		return RecordedSession{}, err
+	}
+
+	index, contents, err := verifySessionArchive(files)
+	if err != nil {
+		return RecordedSession{}, err
+	}
+
+	if name == "" {
+		name = index.Name
+	}
+	if err = validateStorageName(name); err != nil {
+		return RecordedSession{}, err
+	}
+
+	sessions, err := ad.Storage.Sessions()
+	if err != nil && !os.IsNotExist(err) {
+		return RecordedSession{}, err
+	}
+	existing := make(map[string]bool, len(sessions))
+	for _, session := range sessions {
+		existing[session.Name] = true
+	}
+
+	if existing[name] {
+		if !rename {
+			return RecordedSession{}, fmt.Errorf("session %q already exists", name)
+		}
+		base := name
+		for i := 2; existing[name]; i++ {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+	}
+
+	version, err := ad.NewVersion(name)
+	if err != nil {
+		return RecordedSession{}, err
+	}
+
+	for _, fingerprint := range index.Fingerprints {
+		stored, err := contents.load(fingerprint)
+		if err == nil {
+			err = ad.Storage.SaveInteraction(versionKey(name, version), fingerprint, stored)
+		}
+		if err != nil {
+			// do not leave partially imported session behind
+			_ = ad.Storage.DeleteSession(name)
+			return RecordedSession{}, err
+		}
+	}
+
+	err = ad.updateVersion(name, version, func(v *SessionVersion) {
+		v.Selection = index.Selection
+		v.Tags = index.Tags
+	})
+	if err != nil {
+		_ = ad.Storage.DeleteSession(name)
+		return RecordedSession{}, err
+	}
+
+	if ad.Options.Verbose {
+		fmt.Printf("Imported %d interactions into session %q...\n", len(index.Fingerprints), name)
+	}
+	return ad.Show(name)
+}
+
+type sessionArchiveContents map[string]archiveFile
+
+func (sc sessionArchiveContents) load(fingerprint string) (*StoredInteraction, error) {
+	file, found := sc[path.Join("interactions", fingerprint+cassetteSuffix)]
+	if !found {
+		return nil, fmt.Errorf("missing interaction %q", fingerprint)
+	}
+
+	interactions, err := decodeCassette(file.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := &StoredInteraction{
+		Interactions: interactions,
+		Recorded:     file.Modified,
+	}
+	if stats, found := sc[path.Join("interactions", fingerprint+statsSuffix)]; found {
+		if stored.Stats, err = decodeRequestStats(stats.Data); err != nil {
+			return nil, err
+		}
+	}
+	return stored, nil
+}
+
+// verifySessionArchive checks that archive contains exactly the files
+// listed by its index with matching sizes and checksums
+func verifySessionArchive(files []archiveFile) (*sessionIndex, sessionArchiveContents, error) {
+	contents := make(sessionArchiveContents)
+	for _, file := range files {
+		if !file.Dir {
+			contents[file.Name] = file
+		}
+	}
+
+	indexFile, found := contents[sessionIndexFile]
+	if !found {
+		return nil, nil, errors.New("archive does not contain a session")
+	}
+	delete(contents, sessionIndexFile)
+
+	index := &sessionIndex{}
+	if err := yaml.Unmarshal(indexFile.Data, index); err != nil {
+		return nil, nil, err
+	}
+	if index.Version != sessionIndexVersion {
+		return nil, nil, fmt.Errorf("unsupported session archive version %d", index.Version)
+	}
+
+	listed := make(map[string]bool, len(index.Files))
+	for _, expected := range index.Files {
+		file, found := contents[expected.Name]
+		if !found {
+			return nil, nil, fmt.Errorf("archived file %q is missing", expected.Name)
+		}
+
+		sum := sha256.Sum256(file.Data)
+		if len(file.Data) != expected.Size || hex.EncodeToString(sum[:]) != strings.ToLower(expected.SHA256) {
+			return nil, nil, fmt.Errorf("checksum of archived file %q does not match", expected.Name)
+		}
+		listed[expected.Name] = true
+	}
+
+	for fileName := range contents {
+		if !listed[fileName] {
+			return nil, nil, fmt.Errorf("archived file %q is not listed in session index", fileName)
+		}
+	}
+	return index, contents, nil
+}
+
+// writeArchive writes files as gzipped tar sorted by name so that equal
+// contents produce equal archives
+func writeArchive(w io.Writer, files []archiveFile) error {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	for _, file := range files {
+		header := &tar.Header{
+			Name:    file.Name,
+			Mode:    0644,
+			Size:    int64(len(file.Data)),
+			ModTime: file.Modified,
+		}
+		if file.Dir {
+			header.Name += "/"
+			header.Typeflag = tar.TypeDir
+			header.Mode = 0755
+			header.Size = 0
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !file.Dir {
+			if _, err := tw.Write(file.Data); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// readArchive reads regular files and directories of gzipped tar,
+// names escaping archive root are rejected
+func readArchive(r io.Reader) ([]archiveFile, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	var files []archiveFile
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimSuffix(path.Clean(header.Name), "/")
+		if path.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("invalid archived file name %q", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			files = append(files, archiveFile{Name: name, Modified: header.ModTime, Dir: true})
+		case tar.TypeReg, tar.TypeRegA:
+			if header.Size > maxArchiveFileSize {
+				return nil, fmt.Errorf("archived file %q is too large", header.Name)
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(tr, maxArchiveFileSize))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, archiveFile{Name: name, Data: data, Modified: header.ModTime})
+		}
+	}
+	return files, nil
+}
+
+// writeFileAtomically writes into temporary file that replaces target
+// only when writing succeeded
+func writeFileAtomically(filename string, write func(w io.Writer) error) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err = write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,271 @@
+package apidiff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Auth authenticates recorded requests. Secrets are read from environment
+// variables so they are part of neither manifests nor stored sessions.
+type Auth struct {
+	Basic  *BasicAuth  `yaml:"basic,omitempty"`
+	Bearer *BearerAuth `yaml:"bearer,omitempty"`
+	APIKey *APIKeyAuth `yaml:"api_key,omitempty"`
+	OAuth2 *OAuth2Auth `yaml:"oauth2,omitempty"`
+}
+
+// BasicAuth sends username and password using Basic scheme
+type BasicAuth struct {
+	Username    string `yaml:"username"`
+	PasswordEnv string `yaml:"password_env"`
+}
+
+// BearerAuth sends static token using Bearer scheme
+type BearerAuth struct {
+	TokenEnv string `yaml:"token_env"`
+}
+
+// Locations of API key
+const (
+	APIKeyInHeader = "header"
+	APIKeyInQuery  = "query"
+)
+
+// APIKeyAuth sends API key as header or query parameter
+type APIKeyAuth struct {
+	Name string `yaml:"name"`
+	// In is header or query, header is used when empty
+	In       string `yaml:"in,omitempty"`
+	ValueEnv string `yaml:"value_env"`
+}
+
+// OAuth2Auth sends token obtained by OAuth2 client credentials grant,
+// token is cached until it expires
+type OAuth2Auth struct {
+	TokenURL        string   `yaml:"token_url"`
+	ClientID        string   `yaml:"client_id"`
+	ClientSecretEnv string   `yaml:"client_secret_env"`
+	Scopes          []string `yaml:"scopes,omitempty"`
+}
+
+// Validate checks that exactly one authentication method is complete
+func (a *Auth) Validate() error {
+	methods := 0
+	for _, set := range []bool{a.Basic != nil, a.Bearer != nil, a.APIKey != nil, a.OAuth2 != nil} {
+		if set {
+			methods++
+		}
+	}
+	if methods != 1 {
+		return errors.New("auth has to use exactly one of basic, bearer, api_key and oauth2")
+	}
+
+	switch {
+	case a.Basic != nil:
+		if a.Basic.Username == "" || a.Basic.PasswordEnv == "" {
+			return errors.New("basic auth requires username and password_env")
+		}
+	case a.Bearer != nil:
+		if a.Bearer.TokenEnv == "" {
+			return errors.New("bearer auth requires token_env")
+		}
+	case a.APIKey != nil:
+		if a.APIKey.Name == "" || a.APIKey.ValueEnv == "" {
+			return errors.New("api_key auth requires name and value_env")
+		}
+		if a.APIKey.In != "" && a.APIKey.In != APIKeyInHeader && a.APIKey.In != APIKeyInQuery {
+			return fmt.Errorf("unknown api_key location %q (header or query)", a.APIKey.In)
+		}
+	case a.OAuth2 != nil:
+		uri, err := url.Parse(a.OAuth2.TokenURL)
+		if err != nil || (uri.Scheme != "http" && uri.Scheme != "https") {
+			return fmt.Errorf("invalid oauth2 token_url %q", a.OAuth2.TokenURL)
+		}
+		if a.OAuth2.ClientID == "" || a.OAuth2.ClientSecretEnv == "" {
+			return errors.New("oauth2 auth requires client_id and client_secret_env")
+		}
+	}
+	return nil
+}
+
+// environment returns names of environment variables holding secrets
+func (a *Auth) environment() []string {
+	switch {
+	case a.Basic != nil:
+		return []string{a.Basic.PasswordEnv}
+	case a.Bearer != nil:
+		return []string{a.Bearer.TokenEnv}
+	case a.APIKey != nil:
+		return []string{a.APIKey.ValueEnv}
+	case a.OAuth2 != nil:
+		return []string{a.OAuth2.ClientSecretEnv}
+	}
+	return nil
+}
+
+// authenticate adds credentials to request
+func (a *Auth) authenticate(req *http.Request) error {
+	switch {
+	case a.Basic != nil:
+		password, err := secretFromEnv(a.Basic.PasswordEnv)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(a.Basic.Username, password)
+	case a.Bearer != nil:
+		token, err := secretFromEnv(a.Bearer.TokenEnv)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case a.APIKey != nil:
+		key, err := secretFromEnv(a.APIKey.ValueEnv)
+		if err != nil {
+			return err
+		}
+		if a.APIKey.In == APIKeyInQuery {
+			query := req.URL.Query()
+			query.Set(a.APIKey.Name, key)
+			req.URL.RawQuery = query.Encode()
+		} else {
+			req.Header.Set(a.APIKey.Name, key)
+		}
+	case a.OAuth2 != nil:
+		token, err := a.OAuth2.token()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// redactionRule returns rule redacting credentials added by
+// authenticate, it applies even when default redaction is disabled
+func (a *Auth) redactionRule() (Rule, error) {
+	disabled := false
+	options := RedactOptions{Defaults: &disabled}
+	if a.APIKey == nil {
+		options.Headers = []string{"Authorization"}
+	} else if a.APIKey.In == APIKeyInQuery {
+		options.Query = []string{a.APIKey.Name}
+	} else {
+		options.Headers = []string{a.APIKey.Name}
+	}
+
+	rule, err := compileRedaction(options)
+	if err != nil {
+		return nil, err
+	}
+	rule.name = "auth"
+	return rule, nil
+}
+
+func secretFromEnv(name string) (string, error) {
+	value, found := os.LookupEnv(name)
+	if !found {
+		return "", fmt.Errorf("environment variable %q is not set", name)
+	}
+	return value, nil
+}
+
+// oauth2TokenExpiryDelta refreshes tokens before they expire so requests
+// are not sent with a token expiring in flight
+const oauth2TokenExpiryDelta = 10 * time.Second
+
+type oauth2Token struct {
+	value   string
+	expires time.Time
+}
+
+// oauth2Tokens caches tokens by endpoint, client and scopes
+var oauth2Tokens = struct {
+	sync.Mutex
+	tokens map[string]oauth2Token
+}{
+	tokens: make(map[string]oauth2Token),
+}
+
+// token returns cached token or obtains a new one when it expired
+func (o *OAuth2Auth) token() (string, error) {
+	key := strings.Join([]string{o.TokenURL, o.ClientID, strings.Join(o.Scopes, " ")}, "\n")
+
+	oauth2Tokens.Lock()
+	defer oauth2Tokens.Unlock()
+
+	cached, found := oauth2Tokens.tokens[key]
+	if found && (cached.expires.IsZero() || time.Now().Before(cached.expires)) {
+		return cached.value, nil
+	}
+
+	token, err := o.requestToken()
+	if err != nil {
+		return "", err
+	}
+	oauth2Tokens.tokens[key] = token
+	return token.value, nil
+}
+
+// requestToken obtains token from token endpoint, the exchange is never
+// recorded
+func (o *OAuth2Auth) requestToken() (oauth2Token, error) {
+	secret, err := secretFromEnv(o.ClientSecretEnv)
+	if err != nil {
+		return oauth2Token{}, err
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(o.Scopes) > 0 {
+		form.Set("scope", strings.Join(o.Scopes, " "))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, o.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oauth2Token{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(o.ClientID, secret)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return oauth2Token{}, fmt.Errorf("unable to obtain oauth2 token - %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return oauth2Token{}, err
+	}
+
+	var document struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.Unmarshal(body, &document); err != nil && resp.StatusCode == http.StatusOK {
+		return oauth2Token{}, fmt.Errorf("invalid oauth2 token response - %s", err)
+	}
+	if resp.StatusCode != http.StatusOK || document.AccessToken == "" {
+		reason := strings.TrimSpace(document.Error + " " + document.ErrorDescription)
+		if reason == "" {
+			reason = "missing access_token"
+		}
+		return oauth2Token{}, fmt.Errorf("unable to obtain oauth2 token with status %s - %s", resp.Status, reason)
+	}
+
+	token := oauth2Token{value: document.AccessToken}
+	if document.ExpiresIn > 0 {
+		token.expires = time.Now().Add(time.Duration(document.ExpiresIn)*time.Second - oauth2TokenExpiryDelta)
+	}
+	return token, nil
+}
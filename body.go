@@ -0,0 +1,285 @@
+package apidiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// Values holds query parameters or form fields of manifest interaction,
+// a key takes a single value or a list of values
+type Values map[string][]string
+
+// UnmarshalYAML implements yaml.Unmarshaler interface
+func (v *Values) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw map[string]interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	values := make(Values, len(raw))
+	for key, value := range raw {
+		switch value := value.(type) {
+		case []interface{}:
+			for _, item := range value {
+				if !isScalar(item) {
+					return fmt.Errorf("value of %q has to be a scalar or a list of scalars", key)
+				}
+				values[key] = append(values[key], fmt.Sprint(item))
+			}
+		case nil:
+			values[key] = []string{""}
+		default:
+			if !isScalar(value) {
+				return fmt.Errorf("value of %q has to be a scalar or a list of scalars", key)
+			}
+			values[key] = []string{fmt.Sprint(value)}
+		}
+	}
+	*v = values
+	return nil
+}
+
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case map[interface{}]interface{}, []interface{}:
+		return false
+	}
+	return true
+}
+
+// Multipart describes multipart/form-data body, files are read relative
+// to manifest they are defined in
+type Multipart struct {
+	Fields Values `yaml:"fields,omitempty"`
+	Files  Values `yaml:"files,omitempty"`
+}
+
+// bodies returns names of body options set on interaction
+func (ri RequestInteraction) bodies() []string {
+	var bodies []string
+	if ri.Payload != "" {
+		bodies = append(bodies, "body")
+	}
+	if ri.BodyFile != "" {
+		bodies = append(bodies, "body_file")
+	}
+	if len(ri.Form) > 0 {
+		bodies = append(bodies, "form")
+	}
+	if ri.Multipart != nil {
+		bodies = append(bodies, "multipart")
+	}
+	if ri.JSON != nil {
+		bodies = append(bodies, "json")
+	}
+	return bodies
+}
+
+// requestURL returns URL with query parameters of interaction appended
+func (ri RequestInteraction) requestURL() string {
+	if len(ri.Query) == 0 {
+		return ri.URL
+	}
+
+	uri, err := url.Parse(ri.URL)
+	if err != nil {
+		return ri.URL
+	}
+	query := uri.Query()
+	for _, key := range sortedKeys(ri.Query) {
+		for _, value := range ri.Query[key] {
+			query.Add(key, value)
+		}
+	}
+	uri.RawQuery = query.Encode()
+	return uri.String()
+}
+
+// body returns request body of interaction and its content type, empty
+// content type is returned when it is not implied by the body
+func (ri RequestInteraction) body() (string, string, error) {
+	if bodies := ri.bodies(); len(bodies) > 1 {
+		return "", "", fmt.Errorf("only one of %s can be used", strings.Join(bodies, ", "))
+	}
+
+	switch {
+	case ri.BodyFile != "":
+		data, err := ioutil.ReadFile(ri.path(ri.BodyFile))
+		if err != nil {
+			return "", "", err
+		}
+		return string(data), mime.TypeByExtension(filepath.Ext(ri.BodyFile)), nil
+	case len(ri.Form) > 0:
+		return url.Values(ri.Form).Encode(), "application/x-www-form-urlencoded", nil
+	case ri.Multipart != nil:
+		return ri.multipartBody()
+	case ri.JSON != nil:
+		body, err := marshalJSON(normalizeYAML(ri.JSON))
+		return body, "application/json", err
+	}
+	return ri.Payload, "", nil
+}
+
+// requestBody returns body of interaction request and its content type,
+// body of interaction replaces shared one except JSON documents that are
+// deep merged
+func requestBody(interaction RequestInteraction, ri RequestInfo) (string, string, error) {
+	if interaction.JSON != nil && ri.JSON != nil {
+		body, err := marshalJSON(mergeJSON(normalizeYAML(ri.JSON), normalizeYAML(interaction.JSON)))
+		return body, "application/json", err
+	}
+	if len(interaction.bodies()) > 0 {
+		return interaction.body()
+	}
+	if ri.JSON != nil {
+		body, err := marshalJSON(normalizeYAML(ri.JSON))
+		return body, "application/json", err
+	}
+	return ri.Payload, "", nil
+}
+
+// mergeJSON merges objects recursively, any other value of override
+// replaces base value
+func mergeJSON(base, override interface{}) interface{} {
+	baseObject, ok := base.(map[string]interface{})
+	if !ok {
+		return override
+	}
+	overrideObject, ok := override.(map[string]interface{})
+	if !ok {
+		return override
+	}
+
+	merged := make(map[string]interface{}, len(baseObject)+len(overrideObject))
+	for key, value := range baseObject {
+		merged[key] = value
+	}
+	for key, value := range overrideObject {
+		if baseValue, found := merged[key]; found {
+			value = mergeJSON(baseValue, value)
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+// marshalJSON encodes value with sorted keys and without escaping HTML
+func marshalJSON(value interface{}) (string, error) {
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// multipartBody encodes fields and files in sorted order using fixed
+// boundary so that recorded requests are reproducible
+func (ri RequestInteraction) multipartBody() (string, string, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if err := writer.SetBoundary(multipartBoundary); err != nil {
+		return "", "", err
+	}
+
+	for _, key := range sortedKeys(ri.Multipart.Fields) {
+		for _, value := range ri.Multipart.Fields[key] {
+			if err := writer.WriteField(key, value); err != nil {
+				return "", "", err
+			}
+		}
+	}
+
+	for _, key := range sortedKeys(ri.Multipart.Files) {
+		for _, filename := range ri.Multipart.Files[key] {
+			data, err := ioutil.ReadFile(ri.path(filename))
+			if err != nil {
+				return "", "", err
+			}
+
+			contentType := mime.TypeByExtension(filepath.Ext(filename))
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			header := make(textproto.MIMEHeader)
+			header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, key, filepath.Base(filename)))
+			header.Set("Content-Type", contentType)
+
+			part, err := writer.CreatePart(header)
+			if err != nil {
+				return "", "", err
+			}
+			if _, err = part.Write(data); err != nil {
+				return "", "", err
+			}
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", "", err
+	}
+	return body.String(), writer.FormDataContentType(), nil
+}
+
+// writeBody writes structured body options into canonical encoding,
+// files are identified by their paths so editing them keeps fingerprint
+func (ri RequestInteraction) writeBody(write func(name, value string)) {
+	write("body", ri.Payload)
+
+	if ri.BodyFile != "" {
+		write("body_file", ri.BodyFile)
+	}
+	if len(ri.Form) > 0 {
+		write("form", url.Values(ri.Form).Encode())
+	}
+	if ri.JSON != nil {
+		if body, err := marshalJSON(normalizeYAML(ri.JSON)); err == nil {
+			write("json", body)
+		}
+	}
+	if ri.Multipart != nil {
+		for _, key := range sortedKeys(ri.Multipart.Fields) {
+			for _, value := range ri.Multipart.Fields[key] {
+				write("field", key)
+				write("value", value)
+			}
+		}
+		for _, key := range sortedKeys(ri.Multipart.Files) {
+			for _, filename := range ri.Multipart.Files[key] {
+				write("file", key)
+				write("path", filename)
+			}
+		}
+	}
+}
+
+// path resolves file relative to manifest interaction is defined in
+func (ri RequestInteraction) path(filename string) string {
+	if filepath.IsAbs(filename) || ri.dir == "" {
+		return filename
+	}
+	return filepath.Join(ri.dir, filename)
+}
+
+// files returns paths of files body of interaction is read from
+func (ri RequestInteraction) files() []string {
+	var files []string
+	if ri.BodyFile != "" {
+		files = append(files, ri.BodyFile)
+	}
+	if ri.Multipart != nil {
+		for _, key := range sortedKeys(ri.Multipart.Files) {
+			files = append(files, ri.Multipart.Files[key]...)
+		}
+	}
+	return files
+}
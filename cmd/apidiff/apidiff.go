@@ -2,12 +2,18 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
 	"path"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tgrk/apidiff"
@@ -28,14 +34,49 @@ var (
 	deleteCmd  = flag.Bool("del", false, "list all recorded API sessions")
 	showCmd    = flag.Bool("show", false, "show recorded API session")
 	detailCmd  = flag.Bool("detail", false, "view detail fo recorded API session")
+	serveCmd   = flag.Bool("serve", false, "serve recorded API session as a mock server")
+	shadowCmd  = flag.Bool("shadow", false, "proxy traffic to primary backend and compare it with candidate backend")
+	initCmd    = flag.Bool("init", false, "generate a new manifest")
+	importCmd  = flag.Bool("import", false, "import a file as manifest (HAR as session when -name is supplied) or a session archive")
+	exportCmd  = flag.Bool("export", false, "export recorded API session")
+	migrateCmd = flag.Bool("migrate", false, "rename interactions of recorded session to current fingerprints")
+	historyCmd = flag.Bool("history", false, "list recorded versions of API session")
+	pinCmd     = flag.Bool("pin", false, "pin version selected by -baseline as session baseline (unpins when omitted)")
+	pruneCmd   = flag.Bool("prune", false, "remove old versions of recorded API session")
+	lintCmd    = flag.Bool("lint", false, "validate manifest and report errors and warnings")
+	acceptCmd  = flag.Bool("accept", false, "compare recorded session against a manifest and accept changed responses as a new version")
 
 	// command specific
 	name      = flag.String("name", "", "name of session to be recorded")
-	directory = flag.String("dir", "", "path where API calls are stored (default $HOME/.apidiff/)")
+	directory = flag.String("dir", "", "path where API calls are stored, a directory or a single .tar.gz archive (default $HOME/.apidiff/)")
+	listen    = flag.String("listen", ":8080", "address of mock server")
+	unmatched = flag.String("unmatched", "404", "mock server behavior for unmatched requests (404, passthrough or fail)")
+	upstream  = flag.String("upstream", "", "URL for passthrough of unmatched requests (default recorded host)")
+	latency   = flag.Bool("latency", false, "replay recorded latency by mock server")
+	primary   = flag.String("primary", "", "URL of primary backend for shadow traffic")
+	candidate = flag.String("candidate", "", "URL of candidate backend for shadow traffic")
+	output    = flag.String("o", "", "path of output file (default STDOUT)")
+	openAPI   = flag.String("from-openapi", "", "path of OpenAPI/Swagger specification used to generate manifest")
+	baseURL   = flag.String("base-url", "", "server URL of generated manifest (default from specification)")
+	tags      = flag.String("tags", "", "comma separated list of tags to select (OpenAPI operations or interactions to record, compare, show and serve)")
+	excluded  = flag.String("exclude-tags", "", "comma separated list of tags of interactions to skip by record, compare, show and serve")
+	prefix    = flag.String("prefix", "", "path prefix of operations to select")
+	format    = flag.String("format", "", "format of imported (har, postman, curl or archive) or exported (har, openapi or archive) file (default from file extension)")
+	hosts     = flag.String("host", "", "comma separated list of hosts to import")
+	mimeTypes = flag.String("content-type", "", "comma separated list of response content types to import")
+	rename    = flag.Bool("rename", false, "rename imported session archive when session already exists")
+	baseline  = flag.Int("baseline", -1, "version of recorded session to use (default pinned or latest version)")
+	against   = flag.Int("against", -1, "version of recorded session to compare baseline against instead of a manifest")
+	keep      = flag.Int("keep", 3, "number of latest versions kept by -prune")
+	selection = flag.String("select", "all", "comma separated interactions accepted by -accept (all, indexes shown by -compare, names, ids or fingerprints)")
+	confirm   = flag.Bool("confirm", false, "interactively confirm every difference accepted by -accept")
+	only      = flag.String("only", "", "regular expression of interaction names or ids to re-record in existing session")
+	indexes   = flag.String("index", "", "comma separated indexes of interactions to re-record in existing session (starting from 0)")
+	tag       = flag.String("tag", "", "comma separated tags of interactions to re-record in existing session")
 )
 
 func main() {
-	flag.Parse()
+	parseFlags(os.Args[1:])
 
 	if flag.NFlag() == 0 {
 		printErrorf("Usage: %s [OPTIONS] argument ...\n", os.Args[0])
@@ -63,6 +104,10 @@ func main() {
 	options := apidiff.Options{
 		Verbose: *verbose,
 		Name:    *name,
+		Selection: apidiff.TagSelection{
+			Tags:        splitList(*tags),
+			ExcludeTags: splitList(*excluded),
+		},
 	}
 
 	ad := apidiff.New(directoryPath, options)
@@ -91,7 +136,7 @@ func main() {
 			os.Exit(1)
 		}
 
-		session, err := ad.Show(sessionName)
+		session, err := showSession(ad, sessionName)
 		if err != nil {
 			printErrorf("Unable to show recorded session due to %s", err)
 			os.Exit(1)
@@ -100,6 +145,45 @@ func main() {
 		ui.ShowSession(session)
 	}
 
+	if *historyCmd || *pinCmd || *pruneCmd {
+		sessionName := *name
+		if flag.NArg() > 0 {
+			sessionName = flag.Arg(0)
+		}
+		if sessionName == "" {
+			printErrorln("Missing session name (-name \"foo\")")
+			os.Exit(1)
+		}
+
+		if *pinCmd {
+			if *baseline < 0 {
+				err = ad.Unpin(sessionName)
+			} else {
+				err = ad.Pin(sessionName, *baseline)
+			}
+			if err != nil {
+				printErrorf("Unable to pin session version due to %s", err)
+				os.Exit(1)
+			}
+		}
+
+		if *pruneCmd {
+			pruned, err := ad.Prune(sessionName, *keep)
+			if err != nil {
+				printErrorf("Unable to prune session versions due to %s", err)
+				os.Exit(1)
+			}
+			printInfof("Removed %d version(s)", len(pruned))
+		}
+
+		versions, current, err := ad.History(sessionName)
+		if err != nil {
+			printErrorf("Unable to show session history due to %s", err)
+			os.Exit(1)
+		}
+		ui.ShowHistory(versions, current)
+	}
+
 	if *detailCmd {
 		sessionName := *name
 		var interactionIndex = 0
@@ -146,7 +230,325 @@ func main() {
 		}
 	}
 
-	if *recordCmd || *compareCmd {
+	if *serveCmd {
+		sessionName := *name
+		if sessionName == "" {
+			printErrorln("Missing session name (-name \"foo\")")
+			os.Exit(1)
+		}
+
+		// matching rules are read from optional manifest
+		var rules []apidiff.MatchingRules
+		if flag.NArg() > 0 {
+			manifest, err := parseManifestFile(flag.Arg(0))
+			if err != nil {
+				printErrorf("Unable to parse manifest due to %s", err)
+				os.Exit(1)
+			}
+			rules = manifest.MatchingRules
+		}
+
+		handler, err := ad.NewReplayHandler(sessionName, rules, apidiff.ServeOptions{
+			Unmatched: apidiff.UnmatchedBehavior(*unmatched),
+			Latency:   *latency,
+			Upstream:  *upstream,
+		})
+		if err != nil {
+			printErrorf("Unable to load recorded session due to %s", err)
+			os.Exit(1)
+		}
+
+		if err := ad.Serve(*listen, handler); err != nil {
+			printErrorf("Mock server stopped due to %s", err)
+			os.Exit(1)
+		}
+	}
+
+	if *shadowCmd {
+		// matching rules are read from optional manifest
+		var rules []apidiff.MatchingRules
+		if flag.NArg() > 0 {
+			manifest, err := parseManifestFile(flag.Arg(0))
+			if err != nil {
+				printErrorf("Unable to parse manifest due to %s", err)
+				os.Exit(1)
+			}
+			rules = manifest.MatchingRules
+		}
+
+		proxy, err := ad.NewShadowProxy(apidiff.ShadowOptions{
+			Name:      *name,
+			Primary:   *primary,
+			Candidate: *candidate,
+			Rules:     rules,
+		})
+		if err != nil {
+			printErrorf("Unable to create shadow proxy due to %s", err)
+			os.Exit(1)
+		}
+
+		server := &http.Server{
+			Addr:    *listen,
+			Handler: proxy,
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				printErrorf("Shadow proxy stopped due to %s", err)
+				os.Exit(1)
+			}
+		}()
+
+		printInfoln(fmt.Sprintf("Shadowing traffic on %q, press Ctrl+C to show differences...", *listen))
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt)
+		<-stop
+
+		if err := server.Shutdown(context.Background()); err != nil {
+			printErrorf("Unable to stop shadow proxy due to %s", err)
+		}
+		proxy.Wait()
+
+		session, differences := proxy.Report()
+		showDifferences(ui, session, differences)
+	}
+
+	if *initCmd {
+		if *openAPI == "" {
+			printErrorln("Missing specification (-from-openapi \"spec.yaml\")")
+			os.Exit(1)
+		}
+
+		f, err := os.Open(*openAPI)
+		if err != nil {
+			printErrorf("Unable to read specification %q", *openAPI)
+			os.Exit(1)
+		}
+		defer f.Close()
+
+		manifest, err := apidiff.NewManifestFromOpenAPI(f, apidiff.OpenAPIOptions{
+			Tags:       splitList(*tags),
+			PathPrefix: *prefix,
+			BaseURL:    *baseURL,
+		})
+		if err != nil {
+			printErrorf("Unable to generate manifest due to %s", err)
+			os.Exit(1)
+		}
+
+		if err := writeManifest(manifest, *output); err != nil {
+			printErrorf("Unable to write manifest due to %s", err)
+			os.Exit(1)
+		}
+	}
+
+	if *importCmd {
+		// curl commands can be pasted into STDIN
+		f := os.Stdin
+		importFormat := *format
+		if flag.NArg() > 0 {
+			filename := flag.Arg(0)
+			if importFormat == "" {
+				importFormat = importFormatFromFilename(filename)
+			}
+
+			f, err = os.Open(filename)
+			if err != nil {
+				printErrorf("Unable to read imported file %q", filename)
+				os.Exit(1)
+			}
+			defer f.Close()
+		} else if importFormat == "" {
+			importFormat = "curl"
+		}
+
+		switch importFormat {
+		case "archive":
+			session, err := ad.ImportSession(f, *name, *rename)
+			if err != nil {
+				printErrorf("Unable to import session archive due to %s", err)
+				os.Exit(1)
+			}
+			ui.ShowSession(session)
+		case "har":
+			har, err := apidiff.ParseHAR(f)
+			if err != nil {
+				printErrorf("Unable to parse HAR file due to %s", err)
+				os.Exit(1)
+			}
+
+			filter := apidiff.HARFilter{
+				Hosts:        splitList(*hosts),
+				ContentTypes: splitList(*mimeTypes),
+			}
+
+			if *name == "" {
+				if err := writeManifest(har.Manifest(filter), *output); err != nil {
+					printErrorf("Unable to write manifest due to %s", err)
+					os.Exit(1)
+				}
+			} else {
+				session, err := ad.ImportHAR(*name, har, filter)
+				if err != nil {
+					printErrorf("Unable to import HAR file due to %s", err)
+					os.Exit(1)
+				}
+				ui.ShowSession(session)
+			}
+		case "postman":
+			manifest, warnings, err := apidiff.NewManifestFromPostman(f, nil)
+			if err != nil {
+				printErrorf("Unable to convert Postman collection due to %s", err)
+				os.Exit(1)
+			}
+			for _, warning := range warnings {
+				printErrorf("Warning: %s", warning)
+			}
+			if err := writeManifest(manifest, *output); err != nil {
+				printErrorf("Unable to write manifest due to %s", err)
+				os.Exit(1)
+			}
+		case "curl":
+			manifest, err := apidiff.NewManifestFromCurl(f)
+			if err != nil {
+				printErrorf("Unable to convert curl commands due to %s", err)
+				os.Exit(1)
+			}
+			if err := writeManifest(manifest, *output); err != nil {
+				printErrorf("Unable to write manifest due to %s", err)
+				os.Exit(1)
+			}
+		default:
+			printErrorf("Unsupported import format %q", importFormat)
+			os.Exit(1)
+		}
+	}
+
+	if *exportCmd {
+		sessionName := *name
+		if flag.NArg() > 0 {
+			sessionName = flag.Arg(0)
+		}
+		if sessionName == "" {
+			printErrorln("Missing session name (-name \"foo\")")
+			os.Exit(1)
+		}
+
+		exportFormat := *format
+		if exportFormat == "" {
+			exportFormat = exportFormatFromFilename(*output)
+		}
+
+		out := os.Stdout
+		if *output != "" {
+			out, err = os.Create(*output)
+			if err != nil {
+				printErrorf("Unable to create output file %q", *output)
+				os.Exit(1)
+			}
+			defer out.Close()
+		}
+
+		switch exportFormat {
+		case "archive":
+			err = ad.ExportSession(sessionName, out)
+		case "har":
+			err = ad.ExportHAR(sessionName, out)
+		case "openapi":
+			err = ad.ExportOpenAPI(sessionName, out)
+		default:
+			printErrorf("Unsupported export format %q", exportFormat)
+			os.Exit(1)
+		}
+		if err != nil {
+			printErrorf("Unable to export recorded session due to %s", err)
+			os.Exit(1)
+		}
+	}
+
+	if *migrateCmd {
+		if *name == "" {
+			printErrorln("Missing session name (-name \"foo\")")
+			os.Exit(1)
+		}
+		if flag.NArg() == 0 {
+			printErrorln("No manifest supplied.")
+			os.Exit(1)
+		}
+
+		manifest, err := parseManifestFile(flag.Arg(0))
+		if err != nil {
+			printErrorf("Unable to parse manifest due to %s", err)
+			os.Exit(1)
+		}
+
+		migrated, err := ad.Migrate(*name, *manifest)
+		if err != nil {
+			printErrorf("Unable to migrate session due to %s", err)
+			os.Exit(1)
+		}
+		printInfof("Migrated %d interactions", migrated)
+	}
+
+	if *lintCmd {
+		if flag.NArg() == 0 {
+			printErrorln("No manifest supplied.")
+			os.Exit(1)
+		}
+
+		issues, err := ad.Lint(flag.Arg(0))
+		if err != nil {
+			printErrorf("Unable to lint manifest due to %s", err)
+			os.Exit(1)
+		}
+
+		failed := false
+		for _, issue := range issues {
+			printInfoln(issue.String())
+			failed = failed || issue.Severity == apidiff.LintError
+		}
+		if failed {
+			os.Exit(1)
+		}
+		if len(issues) == 0 {
+			printInfoln("Manifest is valid")
+		}
+	}
+
+	if *compareCmd && *against >= 0 {
+		if *name == "" {
+			printErrorln("Missing source session name (-name \"foo\")")
+			os.Exit(1)
+		}
+
+		// matching rules are read from optional manifest
+		var rules []apidiff.MatchingRules
+		if flag.NArg() > 0 {
+			manifest, err := parseManifestFile(flag.Arg(0))
+			if err != nil {
+				printErrorf("Unable to parse manifest due to %s", err)
+				os.Exit(1)
+			}
+			rules = manifest.MatchingRules
+		}
+
+		sourceSession, err := showSession(ad, *name)
+		if err != nil {
+			printErrorf("Unable to show recorded session due to %s", err)
+			os.Exit(1)
+		}
+
+		errors, err := ad.CompareVersions(*name, sourceSession.Version, *against, rules)
+		if err != nil {
+			printErrorf("Unable to compare session versions due to %s", err)
+			os.Exit(1)
+		}
+
+		showDifferences(ui, sourceSession, errors)
+		return
+	}
+
+	if *recordCmd || *compareCmd || *acceptCmd {
 		// reads manifest from STDIN or path as last CLI arg
 		reader := bufio.NewReader(os.Stdin)
 		filename := ""
@@ -172,36 +574,41 @@ func main() {
 				os.Exit(1)
 			}
 
-			session := apidiff.RecordedSession{
-				Name: *name,
+			manifest, err := readManifest(reader, filename)
+			if err != nil {
+				printErrorf("Unable to parse source manifest due to %s", err)
+				os.Exit(1)
 			}
+			checkDuplicateFingerprints(manifest)
 
-			manifest := apidiff.NewManifest()
-			err := manifest.Parse(reader)
+			filter, err := interactionFilter()
 			if err != nil {
-				printErrorf("Unable to parse source manifest due to %s", err)
+				printErrorf("Invalid interaction filter - %s", err)
 				os.Exit(1)
 			}
 
 			start := time.Now()
 
-			for _, interaction := range manifest.Interactions {
-				err = ad.Record(
-					ad.DirectoryPath,
-					session.Name,
-					interaction,
-					manifest.Request,
-					manifest.MatchingRules,
-				)
-				if err != nil {
-					printErrorf("Unable to record session due to %s", err)
+			// every recording is stored as a new version of session
+			var version int
+			if filter.Empty() {
+				version, err = ad.RecordVersion(*name, *manifest)
+			} else {
+				var recorded []int
+				version, recorded, err = ad.Rerecord(*name, *manifest, filter)
+				if err == nil {
+					printInfof("Re-recorded interactions %v as version %d of session %q", recorded, version, *name)
 				}
 			}
+			if err != nil {
+				printErrorf("Unable to record session due to %s", err)
+				os.Exit(1)
+			}
 
 			if ad.Options.Verbose {
 				elapsed := time.Since(start)
 
-				fmt.Fprintf(os.Stdout, "Recording finished in %0.3f seconds...\n", elapsed.Seconds())
+				fmt.Fprintf(os.Stdout, "Recording of version %d finished in %0.3f seconds...\n", version, elapsed.Seconds())
 			}
 		}
 
@@ -211,18 +618,25 @@ func main() {
 				os.Exit(1)
 			}
 
-			sourceSession, err := ad.Show(*name)
+			sourceSession, err := showSession(ad, *name)
 			if err != nil {
-				printErrorln("Missing session name (-name \"foo\")")
+				printErrorf("Unable to show recorded session due to %s", err)
 				os.Exit(1)
 			}
 
-			targetManifest := apidiff.NewManifest()
-			err = targetManifest.Parse(reader)
+			targetManifest, err := readManifest(reader, filename)
 			if err != nil {
 				printErrorf("Unable to parse target manifest due to %s", err)
 				os.Exit(1)
 			}
+			checkDuplicateFingerprints(targetManifest)
+
+			if sourceSession.Legacy {
+				printInfof("Session %q uses legacy fingerprints, run -migrate to upgrade it", sourceSession.Name)
+			}
+			if sourceSession.Selection != nil {
+				printInfof("Session %q was recorded with selection of %s, other interactions are not compared", sourceSession.Name, sourceSession.Selection)
+			}
 
 			errors, err := ad.Compare(sourceSession, *targetManifest)
 			if err != nil {
@@ -230,24 +644,235 @@ func main() {
 				os.Exit(1)
 			}
 
-			// display difference only when there are errors
-			hasErrors := false
-			for _, e := range errors {
-				if e.Changed {
-					hasErrors = true
-					break
-				}
+			showDifferences(ui, sourceSession, errors)
+		}
+
+		if *acceptCmd {
+			if *name == "" {
+				printErrorln("Missing source session name (-name \"foo\")")
+				os.Exit(1)
+			}
+			if *confirm && flag.NArg() == 0 {
+				printErrorln("Confirmation requires manifest supplied as a file")
+				os.Exit(1)
+			}
+
+			sourceSession, err := showSession(ad, *name)
+			if err != nil {
+				printErrorf("Unable to show recorded session due to %s", err)
+				os.Exit(1)
 			}
 
-			if hasErrors {
-				ui.ShowComparisonResults(sourceSession, errors)
+			targetManifest, err := readManifest(reader, filename)
+			if err != nil {
+				printErrorf("Unable to parse target manifest due to %s", err)
+				os.Exit(1)
+			}
+			checkDuplicateFingerprints(targetManifest)
+
+			accept := apidiff.AcceptSelected(strings.Split(*selection, ",")...)
+			if *confirm {
+				accept = confirmAccept(ui, sourceSession, accept)
+			}
+
+			version, accepted, err := ad.Accept(sourceSession, *targetManifest, accept)
+			if err != nil {
+				printErrorf("Unable to accept differences due to %s", err)
+				os.Exit(1)
+			}
+
+			if len(accepted) == 0 {
+				printInfoln("No differences accepted")
 			} else {
-				printInfoln("Success. No differences found")
+				printInfof("Accepted interactions %v as version %d of session %q", accepted, version, sourceSession.Name)
 			}
 		}
 	}
 }
 
+// confirmAccept asks on STDIN about every difference selected by accept
+func confirmAccept(ui *apidiff.UI, session apidiff.RecordedSession, accept apidiff.AcceptFunc) apidiff.AcceptFunc {
+	answers := bufio.NewReader(os.Stdin)
+	return func(interaction apidiff.RequestInteraction, difference apidiff.Differences) bool {
+		if !accept(interaction, difference) {
+			return false
+		}
+
+		ui.ShowComparisonResults(session, map[int]apidiff.Differences{
+			difference.InteractionIndex: difference,
+		})
+		fmt.Fprintf(os.Stdout, "Accept interaction %d (%s)? [y/N] ", difference.InteractionIndex, difference.URL)
+
+		answer, _ := answers.ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
+	}
+}
+
+// parseFlags parses command line allowing flags to follow positional
+// arguments as in "-export foo -o foo.tar.gz"
+func parseFlags(args []string) {
+	var positional []string
+	for {
+		if err := flag.CommandLine.Parse(args); err != nil {
+			os.Exit(2)
+		}
+		if flag.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flag.Arg(0))
+		args = flag.Args()[1:]
+	}
+
+	// positional arguments are exposed through flag.Args
+	if err := flag.CommandLine.Parse(append([]string{"--"}, positional...)); err != nil {
+		os.Exit(2)
+	}
+}
+
+func showDifferences(ui *apidiff.UI, session apidiff.RecordedSession, errors map[int]apidiff.Differences) {
+	// display difference only when there are errors
+	hasErrors := false
+	for _, e := range errors {
+		if e.Changed {
+			hasErrors = true
+			break
+		}
+	}
+
+	if hasErrors {
+		ui.ShowComparisonResults(session, errors)
+	} else {
+		printInfoln("Success. No differences found")
+	}
+}
+
+// interactionFilter returns filter of re-recorded interactions
+func interactionFilter() (apidiff.InteractionFilter, error) {
+	var filter apidiff.InteractionFilter
+
+	if *only != "" {
+		re, err := regexp.Compile(*only)
+		if err != nil {
+			return filter, err
+		}
+		filter.Only = re
+	}
+
+	for _, value := range splitList(*indexes) {
+		index, err := strconv.Atoi(value)
+		if err != nil || index < 0 {
+			return filter, fmt.Errorf("invalid interaction index %q", value)
+		}
+		filter.Indexes = append(filter.Indexes, index)
+	}
+
+	filter.Tags = splitList(*tag)
+	return filter, nil
+}
+
+// showSession returns session version selected by -baseline flag
+func showSession(ad *apidiff.APIDiff, name string) (apidiff.RecordedSession, error) {
+	if *baseline < 0 {
+		return ad.Show(name)
+	}
+	return ad.ShowVersion(name, *baseline)
+}
+
+// checkDuplicateFingerprints exits when manifest interactions would
+// overwrite each other's recordings
+func checkDuplicateFingerprints(manifest *apidiff.Manifest) {
+	duplicates := manifest.DuplicateFingerprints()
+	if len(duplicates) == 0 {
+		return
+	}
+
+	for fingerprint, indexes := range duplicates {
+		var interactions []string
+		for _, i := range indexes {
+			interaction := strconv.Itoa(i)
+			if origin := manifest.Interactions[i].Origin(); origin != "" {
+				interaction += " (" + origin + ")"
+			}
+			interactions = append(interactions, interaction)
+		}
+		printErrorf("Interactions %s share fingerprint %s", strings.Join(interactions, ", "), fingerprint)
+	}
+	os.Exit(1)
+}
+
+func parseManifestFile(filename string) (*apidiff.Manifest, error) {
+	manifest := apidiff.NewManifest()
+	if err := manifest.ParseFile(filename); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// readManifest parses manifest file so its includes are resolved
+// relative to it, otherwise manifest is read from STDIN
+func readManifest(r io.Reader, filename string) (*apidiff.Manifest, error) {
+	if filename != "" {
+		return parseManifestFile(filename)
+	}
+
+	manifest := apidiff.NewManifest()
+	if err := manifest.Parse(r); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func writeManifest(manifest *apidiff.Manifest, filename string) error {
+	if filename == "" {
+		return manifest.Write(os.Stdout)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return manifest.Write(f)
+}
+
+func importFormatFromFilename(filename string) string {
+	filename = strings.ToLower(filename)
+	switch {
+	case apidiff.IsArchivePath(filename):
+		return "archive"
+	case strings.HasSuffix(filename, ".har"):
+		return "har"
+	case strings.HasSuffix(filename, ".json"):
+		return "postman"
+	case strings.HasSuffix(filename, ".sh"), strings.HasSuffix(filename, ".txt"), strings.HasSuffix(filename, ".curl"):
+		return "curl"
+	}
+	return strings.TrimPrefix(path.Ext(filename), ".")
+}
+
+func exportFormatFromFilename(filename string) string {
+	filename = strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(filename, ".yaml"), strings.HasSuffix(filename, ".yml"):
+		return "openapi"
+	case apidiff.IsArchivePath(filename):
+		return "archive"
+	}
+	return "har"
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func ensureDefaultDirectoryExists() (string, error) {
 	dirPath, err := getDefaultDirectory()
 	if err != nil {
@@ -279,3 +904,7 @@ func printErrorln(message string) {
 func printErrorf(message string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, message+"\n", args...)
 }
+
+func printInfof(message string, args ...interface{}) {
+	fmt.Fprintf(os.Stdout, message+"\n", args...)
+}
@@ -0,0 +1,388 @@
+package apidiff
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// curl options that consume following argument
+var curlValueOptions = map[string]string{
+	"-X": "--request",
+	"-H": "--header",
+	"-d": "--data",
+	"-u": "--user",
+	"-A": "--user-agent",
+	"-b": "--cookie",
+	"-e": "--referer",
+	"-F": "--form",
+	"-o": "--output",
+	"-m": "--max-time",
+	"-w": "--write-out",
+	"-x": "--proxy",
+	"-c": "--cookie-jar",
+	"-E": "--cert",
+	"-T": "--upload-file",
+}
+
+// long curl options that consume following argument and are ignored
+var curlIgnoredValueOptions = map[string]bool{
+	"--output":          true,
+	"--max-time":        true,
+	"--write-out":       true,
+	"--proxy":           true,
+	"--cookie-jar":      true,
+	"--cert":            true,
+	"--key":             true,
+	"--cacert":          true,
+	"--connect-timeout": true,
+	"--retry":           true,
+	"--resolve":         true,
+	"--max-redirs":      true,
+	"--limit-rate":      true,
+}
+
+// NewManifestFromCurl converts curl command lines into manifest
+// interactions, commands can span multiple lines using backslash
+func NewManifestFromCurl(r io.Reader) (*Manifest, error) {
+	manifest := NewManifest()
+	manifest.Version = 1
+
+	var command strings.Builder
+	flush := func() error {
+		line := strings.TrimSpace(command.String())
+		command.Reset()
+		if line == "" {
+			return nil
+		}
+
+		interaction, err := ParseCurl(line)
+		if err != nil {
+			return err
+		}
+		manifest.Interactions = append(manifest.Interactions, interaction)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if command.Len() == 0 && (line == "" || strings.HasPrefix(line, "#")) {
+			continue
+		}
+
+		// strip shell prompt of pasted commands
+		if command.Len() == 0 {
+			line = strings.TrimPrefix(line, "$ ")
+		}
+
+		if strings.HasSuffix(line, "\\") {
+			command.WriteString(strings.TrimSuffix(line, "\\"))
+			command.WriteString(" ")
+			continue
+		}
+
+		command.WriteString(line)
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	if len(manifest.Interactions) == 0 {
+		return nil, errors.New("no curl command found")
+	}
+	return manifest, nil
+}
+
+// ParseCurl converts single curl command line into manifest interaction
+func ParseCurl(command string) (RequestInteraction, error) {
+	interaction := RequestInteraction{
+		Headers: http.Header{},
+	}
+
+	args, err := splitCommandLine(command)
+	if err != nil {
+		return interaction, err
+	}
+	if len(args) == 0 || args[0] != "curl" {
+		return interaction, fmt.Errorf("not a curl command %q", command)
+	}
+
+	var (
+		method  string
+		rawURL  string
+		data    []string
+		fields  []multipartField
+		useGet  bool
+		options = expandCurlOptions(args[1:])
+	)
+
+	for i := 0; i < len(options); i++ {
+		option := options[i]
+
+		value := func() (string, error) {
+			if i+1 >= len(options) {
+				return "", fmt.Errorf("missing value of curl option %q", option)
+			}
+			i++
+			return options[i], nil
+		}
+
+		if !strings.HasPrefix(option, "-") || option == "-" {
+			if rawURL == "" {
+				rawURL = option
+			}
+			continue
+		}
+
+		switch option {
+		case "--request":
+			if method, err = value(); err != nil {
+				return interaction, err
+			}
+		case "--url":
+			if rawURL, err = value(); err != nil {
+				return interaction, err
+			}
+		case "--header":
+			header, err := value()
+			if err != nil {
+				return interaction, err
+			}
+			parts := strings.SplitN(header, ":", 2)
+			if len(parts) == 2 {
+				interaction.Headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+			}
+		case "--data", "--data-raw", "--data-binary", "--data-ascii":
+			d, err := value()
+			if err != nil {
+				return interaction, err
+			}
+			if strings.HasPrefix(d, "@") && option != "--data-raw" {
+				return interaction, fmt.Errorf("reading data from file %q is not supported", d[1:])
+			}
+			data = append(data, d)
+		case "--data-urlencode":
+			d, err := value()
+			if err != nil {
+				return interaction, err
+			}
+			if parts := strings.SplitN(d, "=", 2); len(parts) == 2 {
+				d = parts[0] + "=" + url.QueryEscape(parts[1])
+			} else {
+				d = url.QueryEscape(d)
+			}
+			data = append(data, d)
+		case "--json":
+			d, err := value()
+			if err != nil {
+				return interaction, err
+			}
+			data = append(data, d)
+			interaction.Headers.Set("Content-Type", "application/json")
+			interaction.Headers.Set("Accept", "application/json")
+		case "--form", "--form-string":
+			field, err := value()
+			if err != nil {
+				return interaction, err
+			}
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				return interaction, fmt.Errorf("invalid form field %q", field)
+			}
+			if option == "--form" && (strings.HasPrefix(parts[1], "@") || strings.HasPrefix(parts[1], "<")) {
+				return interaction, fmt.Errorf("file form field %q is not supported", parts[0])
+			}
+			fields = append(fields, multipartField{Name: parts[0], Value: parts[1]})
+		case "--user":
+			credentials, err := value()
+			if err != nil {
+				return interaction, err
+			}
+			interaction.Headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+		case "--user-agent":
+			agent, err := value()
+			if err != nil {
+				return interaction, err
+			}
+			interaction.Headers.Set("User-Agent", agent)
+		case "--referer":
+			referer, err := value()
+			if err != nil {
+				return interaction, err
+			}
+			interaction.Headers.Set("Referer", referer)
+		case "--cookie":
+			cookie, err := value()
+			if err != nil {
+				return interaction, err
+			}
+			// without "=" the value is a cookie file name
+			if strings.Contains(cookie, "=") {
+				interaction.Headers.Set("Cookie", cookie)
+			}
+		case "--head":
+			method = "HEAD"
+		case "--get":
+			useGet = true
+		case "--upload-file":
+			return interaction, errors.New("uploading files is not supported")
+		default:
+			if curlIgnoredValueOptions[option] {
+				if _, err := value(); err != nil {
+					return interaction, err
+				}
+			}
+		}
+	}
+
+	if rawURL == "" {
+		return interaction, fmt.Errorf("missing URL in curl command %q", command)
+	}
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+
+	if useGet && len(data) > 0 {
+		separator := "?"
+		if strings.Contains(rawURL, "?") {
+			separator = "&"
+		}
+		rawURL += separator + strings.Join(data, "&")
+		data = nil
+	}
+
+	switch {
+	case len(fields) > 0:
+		contentType, payload, err := multipartBody(fields)
+		if err != nil {
+			return interaction, err
+		}
+		interaction.Payload = payload
+		interaction.Headers.Set("Content-Type", contentType)
+	case len(data) > 0:
+		interaction.Payload = strings.Join(data, "&")
+		if interaction.Headers.Get("Content-Type") == "" {
+			interaction.Headers.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+
+	if method == "" {
+		method = "GET"
+		if interaction.Payload != "" {
+			method = "POST"
+		}
+	}
+
+	interaction.URL = rawURL
+	interaction.Method = strings.ToLower(method)
+	if len(interaction.Headers) == 0 {
+		interaction.Headers = nil
+	}
+	return interaction, nil
+}
+
+// expandCurlOptions converts short options into long ones, splitting
+// combined flags (-sSL) and attached values (-XPOST)
+func expandCurlOptions(args []string) []string {
+	var options []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") || strings.HasPrefix(arg, "--") || len(arg) < 2 {
+			options = append(options, arg)
+			continue
+		}
+
+		for j := 1; j < len(arg); j++ {
+			short := "-" + string(arg[j])
+			long, found := curlValueOptions[short]
+			if !found {
+				switch short {
+				case "-I":
+					options = append(options, "--head")
+				case "-G":
+					options = append(options, "--get")
+				default:
+					options = append(options, short)
+				}
+				continue
+			}
+
+			options = append(options, long)
+			if rest := arg[j+1:]; rest != "" {
+				options = append(options, rest)
+			}
+			break
+		}
+	}
+	return options
+}
+
+// splitCommandLine splits shell command into arguments honoring quotes
+// and escapes
+func splitCommandLine(command string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, c := range command {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case quote == '"':
+			switch c {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				current.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+			inArg = true
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unterminated quote in command")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
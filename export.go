@@ -0,0 +1,397 @@
+package apidiff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dnaeon/go-vcr/cassette"
+	"gopkg.in/yaml.v2"
+)
+
+// path segments that are considered identifiers when inferring paths
+var identifierPattern = regexp.MustCompile(`^(\d+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{24,})$`)
+
+type exportedInteraction struct {
+	interaction *cassette.Interaction
+	stats       RequestStats
+	started     time.Time
+}
+
+// ExportHAR writes recorded session as HTTP Archive document
+func (ad *APIDiff) ExportHAR(name string, w io.Writer) error {
+	interactions, err := ad.exportedInteractions(name)
+	if err != nil {
+		return err
+	}
+
+	har := HAR{
+		Log: HARLog{
+			Version: "1.2",
+			Creator: HARCreator{Name: "apidiff"},
+			Entries: []HAREntry{},
+		},
+	}
+
+	for _, ei := range interactions {
+		req := ei.interaction.Request
+		resp := ei.interaction.Response
+
+		entry := HAREntry{
+			StartedDateTime: ei.started,
+			Time:            float64(ei.stats.Duration()),
+			Request: HARRequest{
+				Method:      req.Method,
+				URL:         req.URL,
+				HTTPVersion: "HTTP/1.1",
+				Cookies:     []HARNameValue{},
+				Headers:     harHeaders(req.Headers),
+				QueryString: []HARNameValue{},
+				HeadersSize: -1,
+				BodySize:    len(req.Body),
+			},
+			Response: HARResponse{
+				Status:      resp.Code,
+				StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.Code))),
+				HTTPVersion: "HTTP/1.1",
+				Cookies:     []HARNameValue{},
+				Headers:     harHeaders(resp.Headers),
+				Content: HARContent{
+					Size:     len(resp.Body),
+					MimeType: resp.Headers.Get("Content-Type"),
+					Text:     resp.Body,
+				},
+				RedirectURL: resp.Headers.Get("Location"),
+				HeadersSize: -1,
+				BodySize:    len(resp.Body),
+			},
+			Timings: HARTimings{
+				Blocked: -1,
+				DNS:     float64(ei.stats.DNSLookup),
+				Connect: float64(ei.stats.TCPConnection + ei.stats.TLSHandshake),
+				SSL:     float64(ei.stats.TLSHandshake),
+				Send:    0,
+				Wait:    float64(ei.stats.ServerProcessing),
+				Receive: float64(ei.stats.ContentTransfer),
+			},
+		}
+
+		if uri, err := url.Parse(req.URL); err == nil {
+			for _, key := range sortedKeys(uri.Query()) {
+				for _, value := range uri.Query()[key] {
+					entry.Request.QueryString = append(entry.Request.QueryString, HARNameValue{Name: key, Value: value})
+				}
+			}
+		}
+
+		if req.Body != "" {
+			entry.Request.PostData = &HARPostData{
+				MimeType: req.Headers.Get("Content-Type"),
+				Text:     req.Body,
+			}
+		}
+
+		har.Log.Entries = append(har.Log.Entries, entry)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(har)
+}
+
+// ExportOpenAPI writes OpenAPI 3.0 draft inferred from recorded session
+// paths, methods, status codes and JSON payloads
+func (ad *APIDiff) ExportOpenAPI(name string, w io.Writer) error {
+	interactions, err := ad.exportedInteractions(name)
+	if err != nil {
+		return err
+	}
+
+	var servers []string
+	paths := make(map[string]map[string]map[string]interface{})
+
+	for _, ei := range interactions {
+		req := ei.interaction.Request
+		resp := ei.interaction.Response
+
+		uri, err := url.Parse(req.URL)
+		if err != nil {
+			return err
+		}
+
+		server := fmt.Sprintf("%s://%s", uri.Scheme, uri.Host)
+		if !containsFold(servers, server) {
+			servers = append(servers, server)
+		}
+
+		template, pathParams := inferPathTemplate(uri.Path)
+		if paths[template] == nil {
+			paths[template] = make(map[string]map[string]interface{})
+		}
+
+		method := strings.ToLower(req.Method)
+		operation := paths[template][method]
+		if operation == nil {
+			operation = map[string]interface{}{
+				"responses": map[string]interface{}{},
+			}
+
+			var parameters []interface{}
+			for _, param := range pathParams {
+				parameters = append(parameters, param)
+			}
+			if len(parameters) > 0 {
+				operation["parameters"] = parameters
+			}
+
+			if content := inferContent(req.Headers, req.Body); content != nil {
+				operation["requestBody"] = map[string]interface{}{
+					"content": content,
+				}
+			}
+			paths[template][method] = operation
+		}
+
+		// query parameters are collected from all observed requests
+		for _, key := range sortedKeys(uri.Query()) {
+			addQueryParameter(operation, key, uri.Query().Get(key))
+		}
+
+		// first observed response of each status code is documented
+		responses := operation["responses"].(map[string]interface{})
+		code := fmt.Sprint(resp.Code)
+		if _, found := responses[code]; !found {
+			response := map[string]interface{}{
+				"description": http.StatusText(resp.Code),
+			}
+			if content := inferContent(resp.Headers, resp.Body); content != nil {
+				response["content"] = content
+			}
+			responses[code] = response
+		}
+	}
+
+	var serverList []interface{}
+	for _, server := range servers {
+		serverList = append(serverList, map[string]interface{}{"url": server})
+	}
+
+	var pathList yaml.MapSlice
+	for _, template := range sortedPathKeys(paths) {
+		var operations yaml.MapSlice
+		for _, method := range openAPIMethods {
+			if operation, found := paths[template][method]; found {
+				operations = append(operations, yaml.MapItem{Key: method, Value: operation})
+			}
+		}
+		pathList = append(pathList, yaml.MapItem{Key: template, Value: operations})
+	}
+
+	document := yaml.MapSlice{
+		{Key: "openapi", Value: "3.0.0"},
+		{Key: "info", Value: yaml.MapSlice{
+			{Key: "title", Value: name},
+			{Key: "version", Value: "draft"},
+		}},
+		{Key: "servers", Value: serverList},
+		{Key: "paths", Value: pathList},
+	}
+
+	data, err := yaml.Marshal(document)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (ad *APIDiff) exportedInteractions(name string) ([]exportedInteraction, error) {
+	key, err := ad.currentKey(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints, err := ad.Storage.Interactions(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var interactions []exportedInteraction
+	for _, fingerprint := range fingerprints {
+		stored, err := ad.Storage.LoadInteraction(key, fingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		// every followed redirect is exported, stats measured for the
+		// whole chain belong to the final exchange and imported sessions
+		// may lack them
+		for _, ci := range stored.Interactions {
+			var stats RequestStats
+			if stored.Stats != nil && ci == stored.Final() {
+				stats = *stored.Stats
+			}
+
+			interactions = append(interactions, exportedInteraction{
+				interaction: ci,
+				stats:       stats,
+				started:     stored.Recorded,
+			})
+		}
+	}
+	return interactions, nil
+}
+
+func inferPathTemplate(p string) (string, []interface{}) {
+	var params []interface{}
+	names := make(map[string]bool)
+
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		if !identifierPattern.MatchString(segment) {
+			continue
+		}
+
+		name := "id"
+		if i > 0 && segments[i-1] != "" && !strings.HasPrefix(segments[i-1], "{") {
+			name = strings.TrimSuffix(segments[i-1], "s") + "Id"
+		}
+		for n := 2; names[name]; n++ {
+			name = fmt.Sprintf("%s%d", strings.TrimRight(name, "0123456789"), n)
+		}
+		names[name] = true
+
+		kind := "string"
+		if strings.Trim(segment, "0123456789") == "" {
+			kind = "integer"
+		}
+
+		params = append(params, map[string]interface{}{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": kind},
+			"example":  segment,
+		})
+		segments[i] = "{" + name + "}"
+	}
+
+	if p == "" {
+		return "/", params
+	}
+	return strings.Join(segments, "/"), params
+}
+
+func addQueryParameter(operation map[string]interface{}, name, example string) {
+	parameters, _ := operation["parameters"].([]interface{})
+	for _, param := range parameters {
+		p := param.(map[string]interface{})
+		if p["in"] == "query" && p["name"] == name {
+			return
+		}
+	}
+
+	operation["parameters"] = append(parameters, map[string]interface{}{
+		"name":     name,
+		"in":       "query",
+		"required": false,
+		"schema":   map[string]interface{}{"type": "string"},
+		"example":  example,
+	})
+}
+
+func inferContent(headers http.Header, body string) map[string]interface{} {
+	if body == "" {
+		return nil
+	}
+
+	contentType := headers.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "application/octet-stream"
+	}
+
+	media := map[string]interface{}{}
+	var value interface{}
+	if err := json.Unmarshal([]byte(body), &value); err == nil {
+		if !strings.Contains(mediaType, "json") {
+			mediaType = "application/json"
+		}
+		media["schema"] = inferSchema(value)
+		media["example"] = value
+	} else {
+		media["schema"] = map[string]interface{}{"type": "string"}
+	}
+
+	return map[string]interface{}{mediaType: media}
+}
+
+func inferSchema(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			properties[key] = inferSchema(child)
+		}
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+		}
+	case []interface{}:
+		schema := map[string]interface{}{"type": "array"}
+		if len(v) > 0 {
+			schema["items"] = inferSchema(v[0])
+		} else {
+			schema["items"] = map[string]interface{}{}
+		}
+		return schema
+	case float64:
+		if v == float64(int64(v)) {
+			return map[string]interface{}{"type": "integer"}
+		}
+		return map[string]interface{}{"type": "number"}
+	case bool:
+		return map[string]interface{}{"type": "boolean"}
+	case string:
+		if _, err := time.Parse(time.RFC3339, v); err == nil {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		return map[string]interface{}{"type": "string"}
+	}
+	return map[string]interface{}{"nullable": true}
+}
+
+func harHeaders(headers http.Header) []HARNameValue {
+	result := []HARNameValue{}
+	for _, key := range sortedKeys(url.Values(headers)) {
+		for _, value := range headers[key] {
+			result = append(result, HARNameValue{Name: key, Value: value})
+		}
+	}
+	return result
+}
+
+func sortedKeys(values map[string][]string) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedPathKeys(paths map[string]map[string]map[string]interface{}) []string {
+	keys := make([]string, 0, len(paths))
+	for k := range paths {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
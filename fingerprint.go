@@ -0,0 +1,305 @@
+package apidiff
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FingerprintVersion prefixes fingerprints so that schemes can be told
+// apart in stored sessions
+const FingerprintVersion = "v2"
+
+// interaction IDs are used as file names
+var interactionIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// FingerprintOptions selects request components that participate in
+// interaction fingerprint, all components are used when not defined.
+// Query lists query keys, "*" selects the whole query regardless of order
+// of its parameters.
+type FingerprintOptions struct {
+	Method     bool     `yaml:"method,omitempty"`
+	Host       bool     `yaml:"host,omitempty"`
+	Path       bool     `yaml:"path,omitempty"`
+	Query      []string `yaml:"query,omitempty"`
+	Headers    []string `yaml:"headers,omitempty"`
+	StatusCode bool     `yaml:"status_code,omitempty"`
+	Body       bool     `yaml:"body,omitempty"`
+	BodyJSON   []string `yaml:"body_json,omitempty"`
+}
+
+// Fingerprint returns unique signature of request that
+// is used for later comparison
+func (ri RequestInteraction) Fingerprint() string {
+	if ri.ID != "" {
+		return "id-" + ri.ID
+	}
+
+	canonical := ri.canonical()
+	if ri.fingerprint != nil {
+		canonical = ri.fingerprint.canonical(ri)
+	}
+
+	sum := sha256.Sum256(canonical)
+	return FingerprintVersion + "-" + hex.EncodeToString(sum[:])
+}
+
+// LegacyFingerprint returns signature used by sessions recorded before
+// fingerprints were versioned
+func (ri RequestInteraction) LegacyFingerprint() string {
+	h := fnv.New32a()
+
+	var sortedHeaderKeys []string
+	for k := range ri.Headers {
+		sortedHeaderKeys = append(sortedHeaderKeys, k)
+	}
+	sort.Strings(sortedHeaderKeys)
+
+	var headers bytes.Buffer
+	for _, name := range sortedHeaderKeys {
+		for _, value := range ri.Headers[name] {
+			headers.WriteString(name)
+			headers.WriteString(value)
+		}
+	}
+
+	fingerprint := fmt.Sprintf(
+		"%s%s%d%s%s",
+		ri.URL,
+		ri.Method,
+		ri.StatusCode,
+		headers.String(),
+		ri.Payload,
+	)
+
+	_, err := h.Write([]byte(fingerprint))
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprint(h.Sum32())
+}
+
+// previousFingerprints returns signatures interaction may have been
+// recorded under before fingerprint composition or scheme changed
+func (ri RequestInteraction) previousFingerprints() []string {
+	var fingerprints []string
+
+	defaults := ri
+	defaults.ID = ""
+	defaults.fingerprint = nil
+	if fingerprint := defaults.Fingerprint(); fingerprint != ri.Fingerprint() {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	return append(fingerprints, ri.LegacyFingerprint())
+}
+
+// canonical returns unambiguous encoding of request where every
+// component is prefixed by its name and length
+func (ri RequestInteraction) canonical() []byte {
+	var buf bytes.Buffer
+	write := canonicalWriter(&buf)
+
+	write("method", strings.ToUpper(ri.Method))
+	write("url", normalizeURL(ri.requestURL()))
+	write("status", fmt.Sprint(ri.StatusCode))
+
+	headers := lowerHeaders(ri.Headers)
+	for _, key := range sortedKeys(headers) {
+		for _, value := range headers[key] {
+			write("header", key)
+			write("value", value)
+		}
+	}
+
+	ri.writeBody(write)
+	return buf.Bytes()
+}
+
+// lowerHeaders merges values of headers by their lower case names as
+// manifest headers keep case they were written in
+func lowerHeaders(header http.Header) map[string][]string {
+	headers := make(map[string][]string, len(header))
+	for _, k := range sortedKeys(header) {
+		key := strings.ToLower(k)
+		headers[key] = append(headers[key], header[k]...)
+	}
+	return headers
+}
+
+// Validate checks that options select at least one request component
+func (fo *FingerprintOptions) Validate() error {
+	if !fo.Method && !fo.Host && !fo.Path && len(fo.Query) == 0 && len(fo.Headers) == 0 &&
+		!fo.StatusCode && !fo.Body && len(fo.BodyJSON) == 0 {
+		return errors.New("fingerprint does not select any request component")
+	}
+	return nil
+}
+
+// canonical encodes only selected components of request, query keys
+// and JSON paths are sorted so that their order in manifest does not
+// matter
+func (fo *FingerprintOptions) canonical(ri RequestInteraction) []byte {
+	var buf bytes.Buffer
+	write := canonicalWriter(&buf)
+
+	uri, err := url.Parse(ri.requestURL())
+	if err != nil {
+		uri = &url.URL{Path: ri.URL}
+	}
+
+	if fo.Method {
+		write("method", strings.ToUpper(ri.Method))
+	}
+	if fo.Host {
+		write("host", strings.ToLower(uri.Host))
+	}
+	if fo.Path {
+		p := uri.EscapedPath()
+		if p == "" {
+			p = "/"
+		}
+		write("path", p)
+	}
+
+	query := uri.Query()
+	for _, key := range sortedCopy(fo.Query) {
+		if key == "*" {
+			write("query", query.Encode())
+			continue
+		}
+		for _, value := range query[key] {
+			write("query", key)
+			write("value", value)
+		}
+	}
+
+	headers := lowerHeaders(ri.Headers)
+	for _, key := range sortedCopy(fo.Headers) {
+		for _, value := range headers[strings.ToLower(key)] {
+			write("header", strings.ToLower(key))
+			write("value", value)
+		}
+	}
+
+	if fo.StatusCode {
+		write("status", fmt.Sprint(ri.StatusCode))
+	}
+	if fo.Body {
+		ri.writeBody(write)
+	}
+
+	if len(fo.BodyJSON) > 0 {
+		var body interface{}
+		if ri.JSON != nil {
+			body = normalizeYAML(ri.JSON)
+		} else if err := json.Unmarshal([]byte(ri.Payload), &body); err != nil {
+			body = nil
+		}
+		for _, p := range sortedCopy(fo.BodyJSON) {
+			write("json", p)
+			value, found := jsonPathValue(body, p)
+			if !found {
+				continue
+			}
+			// encoding/json sorts object keys
+			data, err := json.Marshal(value)
+			if err != nil {
+				continue
+			}
+			write("value", string(data))
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func canonicalWriter(buf *bytes.Buffer) func(name, value string) {
+	return func(name, value string) {
+		fmt.Fprintf(buf, "%s:%d:%s\n", name, len(value), value)
+	}
+}
+
+// jsonPathValue returns value of decoded JSON document addressed by
+// dot separated path where numeric segments index arrays
+func jsonPathValue(document interface{}, p string) (interface{}, bool) {
+	value := document
+	for _, segment := range strings.Split(p, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			child, found := v[segment]
+			if !found {
+				return nil, false
+			}
+			value = child
+		case []interface{}:
+			idx, err := strconv.Atoi(segment)
+			if err != nil || idx < 0 || idx >= len(v) {
+				return nil, false
+			}
+			value = v[idx]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func sortedCopy(values []string) []string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// normalizeURL lower cases scheme and host, strips default ports and
+// sorts query parameters by key
+func normalizeURL(rawURL string) string {
+	uri, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	uri.Scheme = strings.ToLower(uri.Scheme)
+	host := strings.ToLower(uri.Host)
+	if (uri.Scheme == "http" && strings.HasSuffix(host, ":80")) ||
+		(uri.Scheme == "https" && strings.HasSuffix(host, ":443")) {
+		host = host[:strings.LastIndex(host, ":")]
+	}
+	uri.Host = host
+
+	if uri.Path == "" {
+		uri.Path = "/"
+	}
+
+	// order of repeated keys is kept as it may be significant
+	uri.RawQuery = uri.Query().Encode()
+	uri.Fragment = ""
+
+	return uri.String()
+}
+
+// isLegacyFingerprint reports whether cassette name was created by
+// unversioned fingerprint scheme
+func isLegacyFingerprint(name string) bool {
+	name = strings.TrimSuffix(name, ".yaml")
+	return name != "" && strings.Trim(name, "0123456789") == ""
+}
+
+// occurrenceFingerprint keeps repeated captured requests apart, the first
+// occurrence is stored under fingerprint of request and later ones get
+// their number appended
+func occurrenceFingerprint(fingerprint string, occurrence int) string {
+	if occurrence <= 1 {
+		return fingerprint
+	}
+	return fingerprint + "-" + strconv.Itoa(occurrence)
+}
@@ -0,0 +1,335 @@
+package apidiff
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dnaeon/go-vcr/cassette"
+)
+
+// HAR represents HTTP Archive document
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+// HARLog is root of HTTP Archive document
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+// HARCreator identifies application that created HTTP Archive
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HAREntry represents single HTTP Archive request and response
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+}
+
+// HARRequest represents HTTP Archive request
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+// HARResponse represents HTTP Archive response
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+// HARNameValue represents HTTP Archive header, cookie or parameter
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARPostData represents HTTP Archive request payload
+type HARPostData struct {
+	MimeType string         `json:"mimeType"`
+	Text     string         `json:"text"`
+	Params   []HARNameValue `json:"params,omitempty"`
+}
+
+// HARContent represents HTTP Archive response payload
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// HARTimings holds request phases durations in milliseconds where -1
+// means that phase does not apply
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// HARFilter limits imported HTTP Archive entries
+type HARFilter struct {
+	// Hosts of request URLs to import
+	Hosts []string
+	// ContentTypes are prefixes of response MIME types to import
+	ContentTypes []string
+}
+
+// request headers that are set by HTTP client itself
+var harSkippedHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Connection":        true,
+	"Accept-Encoding":   true,
+	"Transfer-Encoding": true,
+}
+
+// ParseHAR reads HTTP Archive document
+func ParseHAR(r io.Reader) (*HAR, error) {
+	har := &HAR{}
+	if err := json.NewDecoder(r).Decode(har); err != nil {
+		return nil, err
+	}
+	return har, nil
+}
+
+// Manifest converts HTTP Archive entries into manifest interactions,
+// repeated requests get id of the occurrence they are imported under
+func (h *HAR) Manifest(filter HARFilter) *Manifest {
+	manifest := NewManifest()
+	manifest.Version = 1
+
+	_, manifest.Interactions = h.interactions(filter)
+	return manifest
+}
+
+// ImportHAR stores HTTP Archive entries as recorded session without
+// replaying them, repeated requests are stored separately under id of
+// their occurrence
+func (ad *APIDiff) ImportHAR(name string, har *HAR, filter HARFilter) (RecordedSession, error) {
+	version, err := ad.NewVersion(name)
+	if err != nil {
+		return RecordedSession{}, err
+	}
+
+	if err = ad.importHAR(versionKey(name, version), har, filter); err != nil {
+		// do not leave partially imported version behind
+		_ = ad.discardVersion(name, version)
+		return RecordedSession{}, err
+	}
+	return ad.ShowVersion(name, version)
+}
+
+func (ad *APIDiff) importHAR(key string, har *HAR, filter HARFilter) error {
+	redact := ad.createStorageFilter(nil)
+	entries, interactions := har.interactions(filter)
+	for i, entry := range entries {
+		interaction, err := entry.recordedInteraction()
+		if err != nil {
+			return err
+		}
+
+		if err = redact(interaction); err != nil {
+			return err
+		}
+
+		fingerprint := interactions[i].Fingerprint()
+		if ad.Options.Verbose {
+			fmt.Printf("Importing %s %q into %q...\n", entry.Request.Method, entry.Request.URL, fingerprint)
+		}
+
+		stats := entry.Timings.stats()
+		err = ad.Storage.SaveInteraction(key, fingerprint, &StoredInteraction{
+			Interactions: []*cassette.Interaction{interaction},
+			Stats:        &stats,
+			Recorded:     entry.StartedDateTime,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// interactions returns entries matching filter and their manifest
+// interactions, occurrence is appended to fingerprint of repeated request
+// to form its id
+func (h *HAR) interactions(filter HARFilter) ([]HAREntry, []RequestInteraction) {
+	var entries []HAREntry
+	var interactions []RequestInteraction
+	occurrences := make(map[string]int)
+	for _, entry := range h.Log.Entries {
+		if !filter.matches(entry) {
+			continue
+		}
+
+		interaction := entry.interaction()
+		fingerprint := interaction.Fingerprint()
+		occurrences[fingerprint]++
+		if occurrences[fingerprint] > 1 {
+			interaction.ID = occurrenceFingerprint(fingerprint, occurrences[fingerprint])
+		}
+		entries = append(entries, entry)
+		interactions = append(interactions, interaction)
+	}
+	return entries, interactions
+}
+
+func (f HARFilter) matches(entry HAREntry) bool {
+	if len(f.Hosts) > 0 {
+		uri, err := url.Parse(entry.Request.URL)
+		if err != nil || !containsFold(f.Hosts, uri.Hostname()) {
+			return false
+		}
+	}
+
+	if len(f.ContentTypes) > 0 {
+		mimeType := strings.ToLower(entry.Response.Content.MimeType)
+		found := false
+		for _, contentType := range f.ContentTypes {
+			if strings.HasPrefix(mimeType, strings.ToLower(contentType)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (e HAREntry) interaction() RequestInteraction {
+	interaction := RequestInteraction{
+		URL:        e.Request.URL,
+		Method:     strings.ToLower(e.Request.Method),
+		StatusCode: e.Response.Status,
+		Headers:    e.requestHeaders(),
+	}
+	if e.Request.PostData != nil {
+		interaction.Payload = e.Request.PostData.Text
+	}
+	if len(interaction.Headers) == 0 {
+		interaction.Headers = nil
+	}
+	return interaction
+}
+
+func (e HAREntry) requestHeaders() http.Header {
+	headers := http.Header{}
+	for _, header := range e.Request.Headers {
+		// skip HTTP/2 pseudo headers
+		if strings.HasPrefix(header.Name, ":") || harSkippedHeaders[http.CanonicalHeaderKey(header.Name)] {
+			continue
+		}
+		headers.Add(header.Name, header.Value)
+	}
+	return headers
+}
+
+func (e HAREntry) recordedInteraction() (*cassette.Interaction, error) {
+	body := e.Response.Content.Text
+	if e.Response.Content.Encoding == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return nil, err
+		}
+		body = string(decoded)
+	}
+
+	interaction := &cassette.Interaction{
+		Request: cassette.Request{
+			Headers: e.requestHeaders(),
+			URL:     e.Request.URL,
+			Method:  strings.ToUpper(e.Request.Method),
+		},
+		Response: cassette.Response{
+			Body:    body,
+			Headers: http.Header{},
+			Status:  fmt.Sprintf("%d %s", e.Response.Status, e.Response.StatusText),
+			Code:    e.Response.Status,
+		},
+	}
+
+	if e.Request.PostData != nil {
+		interaction.Request.Body = e.Request.PostData.Text
+		if len(e.Request.PostData.Params) > 0 {
+			interaction.Request.Form = url.Values{}
+			for _, param := range e.Request.PostData.Params {
+				interaction.Request.Form.Add(param.Name, param.Value)
+			}
+		}
+	}
+
+	for _, header := range e.Response.Headers {
+		// archived content is already decoded
+		name := http.CanonicalHeaderKey(header.Name)
+		if strings.HasPrefix(name, ":") || name == "Content-Encoding" || name == "Content-Length" {
+			continue
+		}
+		interaction.Response.Headers.Add(header.Name, header.Value)
+	}
+
+	return interaction, nil
+}
+
+func (t HARTimings) stats() RequestStats {
+	// connect timing includes SSL/TLS negotiation
+	return RequestStats{
+		DNSLookup:        harMS(t.DNS),
+		TCPConnection:    harMS(t.Connect - math.Max(t.SSL, 0)),
+		TLSHandshake:     harMS(t.SSL),
+		ServerProcessing: harMS(math.Max(t.Send, 0) + math.Max(t.Wait, 0)),
+		ContentTransfer:  harMS(t.Receive),
+	}
+}
+
+func harMS(value float64) int {
+	if value < 0 {
+		return 0
+	}
+	return int(math.Round(value))
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
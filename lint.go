@@ -0,0 +1,262 @@
+package apidiff
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Severities of lint issues
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+)
+
+var yamlLinePattern = regexp.MustCompile(`line (\d+): (.*)`)
+
+// LintIssue describes problem found in manifest file
+type LintIssue struct {
+	File     string
+	Line     int
+	Severity string
+	Message  string
+}
+
+func (li LintIssue) String() string {
+	location := li.File
+	if li.Line > 0 {
+		location = fmt.Sprintf("%s:%d", li.File, li.Line)
+	}
+	return fmt.Sprintf("%s: %s: %s", location, li.Severity, li.Message)
+}
+
+// Lint checks manifest file together with manifests it includes and
+// returns issues ordered by file and line, an error is returned only
+// when the file can not be read
+func (ad *APIDiff) Lint(filename string) ([]LintIssue, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &manifestLinter{ad: ad, linted: make(map[string]bool)}
+	l.lint(filename, data, make(map[string]bool))
+
+	// duplicates are found only across the whole merged manifest
+	manifest := NewManifest()
+	if err = manifest.ParseFile(filename); err == nil {
+		for fingerprint, indexes := range manifest.DuplicateFingerprints() {
+			for _, i := range indexes[1:] {
+				first := manifest.Interactions[indexes[0]]
+				interaction := manifest.Interactions[i]
+				l.add(interaction.origin, interaction.line, LintError,
+					fmt.Sprintf("interaction shares fingerprint %s with interaction at %s:%d", fingerprint, first.origin, first.line))
+			}
+		}
+	}
+
+	sort.SliceStable(l.issues, func(i, j int) bool {
+		if l.issues[i].File != l.issues[j].File {
+			return l.issues[i].File < l.issues[j].File
+		}
+		return l.issues[i].Line < l.issues[j].Line
+	})
+	return l.issues, nil
+}
+
+type manifestLinter struct {
+	ad     *APIDiff
+	linted map[string]bool
+	issues []LintIssue
+}
+
+func (l *manifestLinter) add(file string, line int, severity, message string) {
+	l.issues = append(l.issues, LintIssue{
+		File:     file,
+		Line:     line,
+		Severity: severity,
+		Message:  message,
+	})
+}
+
+func (l *manifestLinter) lint(filename string, data []byte, including map[string]bool) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		l.add(filename, 0, LintError, err.Error())
+		return
+	}
+	if l.linted[abs] {
+		return
+	}
+	l.linted[abs] = true
+	including[abs] = true
+	defer delete(including, abs)
+
+	var m Manifest
+	if err = yaml.UnmarshalStrict(data, &m); err != nil {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			l.addYAMLError(filename, err.Error())
+			return
+		}
+
+		// strict decoding continues after unknown keys
+		for _, message := range typeErr.Errors {
+			l.addYAMLError(filename, message)
+		}
+	}
+	m.dir = filepath.Dir(filename)
+
+	lines := newManifestLines(data)
+	if m.Version == 0 && len(including) == 1 {
+		l.add(filename, 1, LintWarning, fmt.Sprintf("missing version, %d is assumed", supportedManifestVersion))
+	}
+	for _, problem := range m.problems(true) {
+		l.add(filename, lines.find(problem), problem.severity, problem.message)
+	}
+	for i, interaction := range m.Interactions {
+		if interaction.URL != "" && len(unresolvedVariables(interaction)) == 0 && !l.ad.isValidURL(interaction.URL) {
+			line := lines.find(manifestProblem{section: "interactions", index: i, key: "url"})
+			l.add(filename, line, LintError, fmt.Sprintf("invalid URL %q", interaction.URL))
+		}
+	}
+
+	for i, pattern := range m.Include {
+		line := lines.find(manifestProblem{section: "include", index: i})
+
+		filenames, err := m.includedFiles(pattern)
+		if err != nil {
+			l.add(filename, line, LintError, err.Error())
+			continue
+		}
+		for _, included := range filenames {
+			abs, err := filepath.Abs(included)
+			if err == nil && including[abs] {
+				l.add(filename, line, LintError, fmt.Sprintf("manifest %q includes itself", included))
+				continue
+			}
+
+			data, err := ioutil.ReadFile(included)
+			if err != nil {
+				l.add(filename, line, LintError, fmt.Sprintf("unable to include %q - %s", included, err))
+				continue
+			}
+			l.lint(included, data, including)
+		}
+	}
+}
+
+func (l *manifestLinter) addYAMLError(filename, message string) {
+	message = strings.TrimPrefix(message, "yaml: ")
+
+	line := 0
+	if match := yamlLinePattern.FindStringSubmatch(message); match != nil {
+		line, _ = strconv.Atoi(match[1])
+		message = match[2]
+	}
+	l.add(filename, line, LintError, message)
+}
+
+// manifestLines locates manifest sections in YAML document by their
+// indentation, flow style collections are located by their key only
+type manifestLines []string
+
+func newManifestLines(data []byte) manifestLines {
+	return manifestLines(strings.Split(string(data), "\n"))
+}
+
+// find returns 1-based line of problem or 0 when it can not be located
+func (ml manifestLines) find(problem manifestProblem) int {
+	start, end := ml.block(problem.section)
+	if start < 0 {
+		return 0
+	}
+	if problem.index < 0 {
+		return start + 1
+	}
+
+	items := ml.items(start+1, end)
+	if problem.index >= len(items) {
+		return start + 1
+	}
+
+	itemStart := items[problem.index]
+	itemEnd := end
+	if problem.index+1 < len(items) {
+		itemEnd = items[problem.index+1]
+	}
+	if problem.key != "" {
+		for i := itemStart; i < itemEnd; i++ {
+			text := strings.TrimLeft(strings.TrimSpace(ml[i]), "- ")
+			if strings.HasPrefix(text, problem.key+":") {
+				return i + 1
+			}
+		}
+	}
+	return itemStart + 1
+}
+
+// itemLines returns 1-based lines of items of block sequence section
+func (ml manifestLines) itemLines(section string) []int {
+	start, end := ml.block(section)
+	if start < 0 {
+		return nil
+	}
+
+	items := ml.items(start+1, end)
+	for i := range items {
+		items[i]++
+	}
+	return items
+}
+
+// block returns range of lines of top level key
+func (ml manifestLines) block(key string) (int, int) {
+	for i := range ml {
+		if strings.HasPrefix(ml[i], key+":") {
+			end := i + 1
+			for end < len(ml) && (isBlankLine(ml[end]) || indentation(ml[end]) > 0 || strings.HasPrefix(ml[end], "-")) {
+				end++
+			}
+			return i, end
+		}
+	}
+	return -1, -1
+}
+
+// items returns lines starting items of block sequence
+func (ml manifestLines) items(from, to int) []int {
+	var items []int
+	indent := -1
+	for i := from; i < to; i++ {
+		if isBlankLine(ml[i]) {
+			continue
+		}
+		current := indentation(ml[i])
+		if !strings.HasPrefix(ml[i][current:], "-") {
+			continue
+		}
+		if indent < 0 {
+			indent = current
+		}
+		if current == indent {
+			items = append(items, i)
+		}
+	}
+	return items
+}
+
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+func isBlankLine(line string) bool {
+	text := strings.TrimSpace(line)
+	return text == "" || strings.HasPrefix(text, "#")
+}
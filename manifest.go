@@ -2,7 +2,15 @@ package apidiff
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -10,10 +18,20 @@ import (
 // Manifest holds all information needed for running
 // requests against API
 type Manifest struct {
-	Version       int                  `yaml:"version"`
-	MatchingRules []MatchingRules      `yaml:"matching_rules"`
-	Request       RequestInfo          `yaml:"request"`
+	Version int `yaml:"version"`
+	// Include lists paths or glob patterns of manifests merged into this
+	// one, relative paths are resolved against directory of manifest
+	Include       []string             `yaml:"include,omitempty"`
+	MatchingRules []MatchingRules      `yaml:"matching_rules,omitempty"`
+	Request       RequestInfo          `yaml:"request,omitempty"`
+	Auth          *Auth                `yaml:"auth,omitempty"`
+	Cookies       bool                 `yaml:"cookies,omitempty"`
+	Redirects     *RedirectPolicy      `yaml:"redirects,omitempty"`
+	Fingerprint   *FingerprintOptions  `yaml:"fingerprint,omitempty"`
 	Interactions  []RequestInteraction `yaml:"interactions"`
+
+	// directory relative paths are resolved against
+	dir string
 }
 
 // NewManifest creates an empty manifest
@@ -21,13 +39,539 @@ func NewManifest() *Manifest {
 	return &Manifest{}
 }
 
-// Parse YAML document
+// Parse YAML document, included manifests are resolved relative to
+// working directory
 func (m *Manifest) Parse(r io.Reader) error {
+	return m.parse(r, "", make(map[string]bool))
+}
+
+// ParseFile reads YAML document from file, included manifests are
+// resolved relative to the file
+func (m *Manifest) ParseFile(filename string) error {
+	return m.parseFile(filename, make(map[string]bool))
+}
+
+func (m *Manifest) parseFile(filename string, including map[string]bool) error {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	if including[abs] {
+		return fmt.Errorf("manifest %q includes itself", filename)
+	}
+	including[abs] = true
+	defer delete(including, abs)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return m.parse(f, filename, including)
+}
+
+func (m *Manifest) parse(r io.Reader, filename string, including map[string]bool) error {
 	buf := new(bytes.Buffer)
 	_, err := buf.ReadFrom(r)
 	if err != nil {
 		return err
 	}
 
-	return yaml.Unmarshal(buf.Bytes(), m)
+	// unknown keys are rejected
+	if err = yaml.UnmarshalStrict(buf.Bytes(), m); err != nil {
+		return err
+	}
+
+	lines := newManifestLines(buf.Bytes())
+	for _, problem := range m.problems(false) {
+		if problem.severity == LintError {
+			if line := lines.find(problem); line > 0 {
+				return fmt.Errorf("line %d: %s", line, problem)
+			}
+			return problem
+		}
+	}
+
+	items := lines.itemLines("interactions")
+	for i := range m.Interactions {
+		m.Interactions[i].origin = filename
+		if filename != "" {
+			m.Interactions[i].dir = filepath.Dir(filename)
+		}
+		if i < len(items) {
+			m.Interactions[i].line = items[i]
+		}
+	}
+	if filename != "" {
+		m.dir = filepath.Dir(filename)
+	}
+
+	if err = m.resolveIncludes(including); err != nil {
+		return err
+	}
+	return m.configure()
+}
+
+// resolveIncludes merges included manifests in order they are listed,
+// later manifests take precedence over earlier ones and the including
+// manifest over all of them. Interactions are appended in the same order.
+func (m *Manifest) resolveIncludes(including map[string]bool) error {
+	if len(m.Include) == 0 {
+		return nil
+	}
+
+	merged := &Manifest{dir: m.dir}
+	for _, pattern := range m.Include {
+		filenames, err := m.includedFiles(pattern)
+		if err != nil {
+			return err
+		}
+
+		for _, filename := range filenames {
+			included := NewManifest()
+			if err = included.parseFile(filename, including); err != nil {
+				return fmt.Errorf("unable to include %q - %s", filename, err)
+			}
+			merged.merge(included)
+		}
+	}
+
+	m.Include = nil
+	merged.merge(m)
+	*m = *merged
+	return nil
+}
+
+// includedFiles returns files matching include pattern
+func (m *Manifest) includedFiles(pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(m.dir, pattern)
+	}
+	if !strings.ContainsAny(pattern, "*?[") {
+		return []string{pattern}, nil
+	}
+
+	filenames, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("include %q matches no manifest", pattern)
+	}
+	sort.Strings(filenames)
+	return filenames, nil
+}
+
+// merge adds other manifest overriding version, matching rules of the
+// same name, request defaults and fingerprint composition
+func (m *Manifest) merge(other *Manifest) {
+	if other.Version != 0 {
+		m.Version = other.Version
+	}
+
+	m.MatchingRules = mergeRules(m.MatchingRules, other.MatchingRules)
+
+	if other.Request.Payload != "" {
+		m.Request.Payload = other.Request.Payload
+		m.Request.JSON = nil
+	}
+	if other.Request.JSON != nil {
+		m.Request.JSON = mergeJSON(normalizeYAML(m.Request.JSON), normalizeYAML(other.Request.JSON))
+		m.Request.Payload = ""
+	}
+	for key, values := range other.Request.Headers {
+		if m.Request.Headers == nil {
+			m.Request.Headers = make(map[string][]string)
+		}
+		m.Request.Headers[key] = values
+	}
+
+	if other.Auth != nil {
+		m.Auth = other.Auth
+	}
+	m.Cookies = m.Cookies || other.Cookies
+	if other.Redirects != nil {
+		m.Redirects = other.Redirects
+	}
+	if other.Fingerprint != nil {
+		m.Fingerprint = other.Fingerprint
+	}
+
+	m.Interactions = append(m.Interactions, other.Interactions...)
+}
+
+// Write YAML document
+func (m *Manifest) Write(w io.Writer) error {
+	data, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// DuplicateFingerprints returns indexes of manifest interactions sharing
+// the same fingerprint, such interactions would overwrite each other's
+// recordings
+func (m *Manifest) DuplicateFingerprints() map[string][]int {
+	// invalid configuration is reported by Parse
+	_ = m.configure()
+
+	indexes := make(map[string][]int)
+	for i, interaction := range m.Interactions {
+		fingerprint := interaction.Fingerprint()
+		indexes[fingerprint] = append(indexes[fingerprint], i)
+	}
+
+	duplicates := make(map[string][]int)
+	for fingerprint, idx := range indexes {
+		if len(idx) > 1 {
+			duplicates[fingerprint] = idx
+		}
+	}
+	return duplicates
+}
+
+// TagSelection selects interactions by their tags
+type TagSelection struct {
+	// Tags of which interaction has to have at least one
+	Tags []string `yaml:"tags,omitempty"`
+	// ExcludeTags of which interaction must not have any
+	ExcludeTags []string `yaml:"exclude_tags,omitempty"`
+}
+
+// Empty reports whether selection matches all interactions
+func (s TagSelection) Empty() bool {
+	return len(s.Tags) == 0 && len(s.ExcludeTags) == 0
+}
+
+// Match reports whether interaction with given tags is selected
+func (s TagSelection) Match(tags []string) bool {
+	if len(s.Tags) > 0 && !hasAnyTag(tags, s.Tags) {
+		return false
+	}
+	return !hasAnyTag(tags, s.ExcludeTags)
+}
+
+func (s TagSelection) String() string {
+	var parts []string
+	if len(s.Tags) > 0 {
+		parts = append(parts, "tags "+strings.Join(s.Tags, ","))
+	}
+	if len(s.ExcludeTags) > 0 {
+		parts = append(parts, "excluding "+strings.Join(s.ExcludeTags, ","))
+	}
+	if len(parts) == 0 {
+		return "all"
+	}
+	return strings.Join(parts, " ")
+}
+
+// copy returns selection to be stored or nil when it is empty
+func (s TagSelection) copy() *TagSelection {
+	if s.Empty() {
+		return nil
+	}
+	return &TagSelection{
+		Tags:        append([]string(nil), s.Tags...),
+		ExcludeTags: append([]string(nil), s.ExcludeTags...),
+	}
+}
+
+// InteractionFilter selects manifest interactions, an interaction has to
+// match every criterion that is set
+type InteractionFilter struct {
+	// Only matches name or id of interaction
+	Only *regexp.Regexp
+	// Indexes of interactions in manifest starting from 0
+	Indexes []int
+	// Tags of which interaction has to have at least one
+	Tags []string
+}
+
+// Empty reports whether filter has no criteria set
+func (f InteractionFilter) Empty() bool {
+	return f.Only == nil && len(f.Indexes) == 0 && len(f.Tags) == 0
+}
+
+// Match reports whether interaction of given index matches filter
+func (f InteractionFilter) Match(index int, interaction RequestInteraction) bool {
+	if f.Only != nil && !f.Only.MatchString(interaction.Name) && !f.Only.MatchString(interaction.ID) {
+		return false
+	}
+	if len(f.Indexes) > 0 && !containsInt(f.Indexes, index) {
+		return false
+	}
+	if len(f.Tags) > 0 && !hasAnyTag(interaction.Tags, f.Tags) {
+		return false
+	}
+	return true
+}
+
+// Select returns indexes of interactions matching filter
+func (m *Manifest) Select(filter InteractionFilter) []int {
+	var selected []int
+	for i, interaction := range m.Interactions {
+		if filter.Match(i, interaction) {
+			selected = append(selected, i)
+		}
+	}
+	return selected
+}
+
+// configure validates fingerprint settings and propagates them into
+// interactions
+func (m *Manifest) configure() error {
+	if m.Fingerprint != nil {
+		if err := m.Fingerprint.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if m.Auth != nil {
+		if err := m.Auth.Validate(); err != nil {
+			return err
+		}
+	}
+	m.Request.auth = m.Auth
+
+	if m.Redirects != nil {
+		if err := m.Redirects.Validate(); err != nil {
+			return err
+		}
+	}
+	m.Request.redirects = m.Redirects
+
+	for i := range m.Interactions {
+		if id := m.Interactions[i].ID; id != "" && !interactionIDPattern.MatchString(id) {
+			return fmt.Errorf("invalid id %q of interaction %d", id, i)
+		}
+		m.Interactions[i].fingerprint = m.Fingerprint
+	}
+	return nil
+}
+
+// session returns request details shared by interactions recorded in
+// a single run, every run starts with an empty cookie jar
+func (m *Manifest) session() RequestInfo {
+	ri := m.Request
+	if m.Cookies {
+		// jar without public suffix list never fails
+		ri.jar, _ = cookiejar.New(nil)
+	}
+	return ri
+}
+
+// supportedManifestVersion is the only manifest version understood
+const supportedManifestVersion = 1
+
+var httpMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// manifestProblem describes invalid or suspicious part of manifest
+// located by section, index of its item and key
+type manifestProblem struct {
+	severity string
+	section  string
+	index    int
+	key      string
+	message  string
+}
+
+func (mp manifestProblem) Error() string {
+	switch mp.section {
+	case "interactions":
+		return fmt.Sprintf("interaction %d: %s", mp.index, mp.message)
+	case "matching_rules":
+		return fmt.Sprintf("matching rule %d: %s", mp.index, mp.message)
+	}
+	return mp.message
+}
+
+// problems validates manifest as written in a single file, warnings
+// about usable but suspicious values are added for lint
+func (m *Manifest) problems(lint bool) []manifestProblem {
+	var problems []manifestProblem
+	add := func(severity, section string, index int, key, format string, args ...interface{}) {
+		problems = append(problems, manifestProblem{
+			severity: severity,
+			section:  section,
+			index:    index,
+			key:      key,
+			message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	if m.Version != 0 && m.Version != supportedManifestVersion {
+		add(LintError, "version", -1, "", "unsupported manifest version %d", m.Version)
+	}
+
+	if m.Fingerprint != nil {
+		if err := m.Fingerprint.Validate(); err != nil {
+			add(LintError, "fingerprint", -1, "", "%s", err)
+		} else if lint && len(m.Fingerprint.Query) > 1 && containsFold(m.Fingerprint.Query, "*") {
+			add(LintWarning, "fingerprint", -1, "", "query keys are ignored, \"*\" selects the whole query")
+		}
+	}
+
+	if m.Auth != nil {
+		if err := m.Auth.Validate(); err != nil {
+			add(LintError, "auth", -1, "", "%s", err)
+		} else if lint {
+			for _, name := range m.Auth.environment() {
+				if _, found := os.LookupEnv(name); !found {
+					add(LintWarning, "auth", -1, "", "environment variable %q is not set", name)
+				}
+			}
+		}
+	}
+
+	for i, mr := range m.MatchingRules {
+		rule, err := mr.Rule()
+		if err != nil {
+			add(LintError, "matching_rules", i, "value", "%s", err)
+		} else if rule == nil && lint {
+			add(LintWarning, "matching_rules", i, "name", "unknown matching rule %q is ignored", mr.Name)
+		}
+	}
+
+	if matchers := requestMatchers(m.MatchingRules); lint && len(matchers) > 1 {
+		for _, i := range matchers[1:] {
+			add(LintWarning, "matching_rules", i, "name", "request matcher %q is ignored, only the first one %q is used",
+				m.MatchingRules[i].Name, m.MatchingRules[matchers[0]].Name)
+		}
+	}
+
+	if m.Redirects != nil {
+		if err := m.Redirects.Validate(); err != nil {
+			add(LintError, "redirects", -1, "", "%s", err)
+		}
+	}
+
+	if m.Request.Payload != "" && m.Request.JSON != nil {
+		add(LintError, "request", -1, "", "only one of body, json can be used")
+	}
+
+	for i, interaction := range m.Interactions {
+		method := strings.ToUpper(interaction.Method)
+		if method != "" && !httpMethods[method] {
+			add(LintError, "interactions", i, "method", "invalid method %q", interaction.Method)
+		}
+		if id := interaction.ID; id != "" && !interactionIDPattern.MatchString(id) {
+			add(LintError, "interactions", i, "id", "invalid id %q", id)
+		}
+		if interaction.Redirects != nil {
+			if err := interaction.Redirects.Validate(); err != nil {
+				add(LintError, "interactions", i, "redirects", "%s", err)
+			}
+		}
+		if bodies := interaction.bodies(); len(bodies) > 1 {
+			add(LintError, "interactions", i, bodies[1], "only one of %s can be used", strings.Join(bodies, ", "))
+		}
+		for _, mr := range interaction.MatchingRules {
+			rule, err := mr.Rule()
+			if err != nil {
+				add(LintError, "interactions", i, "matching_rules", "%s", err)
+			} else if rule == nil && lint {
+				add(LintWarning, "interactions", i, "matching_rules", "unknown matching rule %q is ignored", mr.Name)
+			}
+		}
+
+		if !lint {
+			continue
+		}
+		if len(requestMatchers(interaction.MatchingRules)) > 0 {
+			merged := mergeRules(m.MatchingRules, interaction.MatchingRules)
+			if matchers := requestMatchers(merged); len(matchers) > 1 {
+				add(LintWarning, "interactions", i, "matching_rules", "only the first request matcher %q is used", merged[matchers[0]].Name)
+			}
+		}
+		if method == "" {
+			add(LintWarning, "interactions", i, "method", "missing method, GET is used")
+		}
+		if interaction.URL == "" {
+			add(LintError, "interactions", i, "", "missing url")
+		}
+		for _, variable := range unresolvedVariables(interaction) {
+			add(LintWarning, "interactions", i, "", "variable %q is never resolved", variable)
+		}
+		for _, filename := range interaction.files() {
+			key := "multipart"
+			if filename == interaction.BodyFile {
+				key = "body_file"
+			}
+			p := filename
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(m.dir, p)
+			}
+			if _, err := os.Stat(p); err != nil {
+				add(LintError, "interactions", i, key, "unable to read %q", filename)
+			}
+		}
+	}
+
+	if lint {
+		for _, variable := range unresolvedVariables(RequestInteraction{
+			Headers: m.Request.Headers,
+			Payload: m.Request.Payload,
+		}) {
+			add(LintWarning, "request", -1, "", "variable %q is never resolved", variable)
+		}
+	}
+
+	return problems
+}
+
+// unresolvedVariables returns names of {{variable}} placeholders left in
+// interaction
+func unresolvedVariables(interaction RequestInteraction) []string {
+	values := []string{interaction.URL, interaction.Payload}
+	for key, headerValues := range interaction.Headers {
+		values = append(values, key)
+		values = append(values, headerValues...)
+	}
+
+	var variables []string
+	found := make(map[string]bool)
+	for _, value := range values {
+		for _, match := range postmanVariablePattern.FindAllStringSubmatch(value, -1) {
+			if !found[match[1]] {
+				found[match[1]] = true
+				variables = append(variables, match[1])
+			}
+		}
+	}
+	sort.Strings(variables)
+	return variables
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyTag(tags []string, selected []string) bool {
+	for _, tag := range tags {
+		for _, s := range selected {
+			if tag == s {
+				return true
+			}
+		}
+	}
+	return false
 }
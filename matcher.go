@@ -0,0 +1,197 @@
+package apidiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/dnaeon/go-vcr/cassette"
+)
+
+// Body matching modes of MatchOptions
+const (
+	MatchBodyExact = "exact"
+	MatchBodyJSON  = "json"
+)
+
+// MatchOptions selects request components that have to be equal for a
+// request to match recorded one
+type MatchOptions struct {
+	Method bool `yaml:"method"`
+	Host   bool `yaml:"host"`
+	Path   bool `yaml:"path"`
+	// Query compares query parameters regardless of their order
+	Query bool `yaml:"query"`
+	// IgnoreQuery lists query parameters left out of comparison
+	IgnoreQuery []string `yaml:"ignore_query,omitempty"`
+	Headers     []string `yaml:"headers,omitempty"`
+	// Body is compared exactly or as equivalent JSON documents, it is
+	// not compared when empty
+	Body string `yaml:"body,omitempty"`
+}
+
+// Validate checks that at least one component is matched
+func (mo MatchOptions) Validate() error {
+	switch mo.Body {
+	case "", MatchBodyExact, MatchBodyJSON:
+	default:
+		return fmt.Errorf("unknown body matching %q (exact or json)", mo.Body)
+	}
+
+	if !mo.Method && !mo.Host && !mo.Path && !mo.Query && len(mo.Headers) == 0 && mo.Body == "" {
+		return errors.New("no request component to match")
+	}
+	return nil
+}
+
+// Match reports whether request matches recorded request, body of
+// request is restored after it is read
+func (mo MatchOptions) Match(r *http.Request, recorded cassette.Request) bool {
+	if mo.Method && !strings.EqualFold(r.Method, recorded.Method) {
+		return false
+	}
+
+	uri, err := url.Parse(recorded.URL)
+	if err != nil {
+		return false
+	}
+	if mo.Host && !strings.EqualFold(r.URL.Host, uri.Host) {
+		return false
+	}
+	if mo.Path && r.URL.Path != uri.Path {
+		return false
+	}
+	if mo.Query && !equalQuery(r.URL.Query(), uri.Query(), mo.IgnoreQuery) {
+		return false
+	}
+
+	for _, header := range mo.Headers {
+		header = http.CanonicalHeaderKey(header)
+		if !equalValues(r.Header[header], recorded.Headers[header]) {
+			return false
+		}
+	}
+
+	if mo.Body == "" {
+		return true
+	}
+	body, err := readRequestBody(r)
+	if err != nil {
+		return false
+	}
+	if mo.Body == MatchBodyJSON {
+		return equalJSON(body, []byte(recorded.Body))
+	}
+	return string(body) == recorded.Body
+}
+
+// matchRule matches requests using configured request components
+type matchRule struct {
+	name    string
+	options MatchOptions
+}
+
+func newMatchRule(value interface{}) (Rule, error) {
+	var options MatchOptions
+	if err := DecodeRuleValue(value, &options); err != nil {
+		return nil, err
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	return matchRule{name: "match", options: options}, nil
+}
+
+// newMatchURLRule matches method and URL with query in any order, other
+// combinations of request components are selected by match rule
+func newMatchURLRule(value interface{}) (Rule, error) {
+	var match bool
+	if err := DecodeRuleValue(value, &match); err != nil {
+		return nil, err
+	}
+	if !match {
+		return nil, errors.New("match_url can only be true, match rule selects other request components")
+	}
+
+	options := MatchOptions{Method: true, Host: true, Path: true, Query: true}
+	return matchRule{name: "match_url", options: options}, nil
+}
+
+func (r matchRule) Name() string {
+	return r.name
+}
+
+func (r matchRule) MatchRequest(req *http.Request, recorded cassette.Request) bool {
+	return r.options.Match(req, recorded)
+}
+
+func equalQuery(a, b url.Values, ignored []string) bool {
+	skip := make(map[string]bool, len(ignored))
+	for _, key := range ignored {
+		skip[key] = true
+	}
+
+	keys := make(map[string]bool)
+	for key := range a {
+		keys[key] = true
+	}
+	for key := range b {
+		keys[key] = true
+	}
+
+	for key := range keys {
+		if !skip[key] && !equalValues(a[key], b[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalValues compares values regardless of their order
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a = sortedCopy(a)
+	b = sortedCopy(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalJSON(a, b []byte) bool {
+	if len(bytes.TrimSpace(a)) == 0 || len(bytes.TrimSpace(b)) == 0 {
+		return len(bytes.TrimSpace(a)) == len(bytes.TrimSpace(b))
+	}
+
+	var da, db interface{}
+	if json.Unmarshal(a, &da) != nil || json.Unmarshal(b, &db) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(da, db)
+}
+
+// readRequestBody returns body of request leaving it readable again
+func readRequestBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
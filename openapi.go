@@ -0,0 +1,578 @@
+package apidiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// OpenAPIOptions holds filters applied when generating manifest from
+// OpenAPI/Swagger specification
+type OpenAPIOptions struct {
+	// Tags limits operations to those having at least one of them
+	Tags []string
+	// PathPrefix limits operations to paths starting with it
+	PathPrefix string
+	// BaseURL overrides server URL defined by specification
+	BaseURL string
+}
+
+// methods in order in which operations are added to manifest
+var openAPIMethods = []string{"get", "put", "post", "delete", "options", "head", "patch"}
+
+// openAPISpec covers both Swagger 2.0 and OpenAPI 3.x documents
+type openAPISpec struct {
+	Swagger     string                      `yaml:"swagger"`
+	OpenAPI     string                      `yaml:"openapi"`
+	Host        string                      `yaml:"host"`
+	BasePath    string                      `yaml:"basePath"`
+	Schemes     []string                    `yaml:"schemes"`
+	Servers     []openAPIServer             `yaml:"servers"`
+	Paths       map[string]openAPIPathItem  `yaml:"paths"`
+	Parameters  map[string]openAPIParameter `yaml:"parameters"`
+	Definitions map[string]*openAPISchema   `yaml:"definitions"`
+	Components  struct {
+		Parameters    map[string]openAPIParameter   `yaml:"parameters"`
+		Schemas       map[string]*openAPISchema     `yaml:"schemas"`
+		RequestBodies map[string]openAPIRequestBody `yaml:"requestBodies"`
+	} `yaml:"components"`
+}
+
+type openAPIServer struct {
+	URL       string `yaml:"url"`
+	Variables map[string]struct {
+		Default string `yaml:"default"`
+	} `yaml:"variables"`
+}
+
+type openAPIPathItem struct {
+	Parameters []openAPIParameter `yaml:"parameters"`
+	Get        *openAPIOperation  `yaml:"get"`
+	Put        *openAPIOperation  `yaml:"put"`
+	Post       *openAPIOperation  `yaml:"post"`
+	Delete     *openAPIOperation  `yaml:"delete"`
+	Options    *openAPIOperation  `yaml:"options"`
+	Head       *openAPIOperation  `yaml:"head"`
+	Patch      *openAPIOperation  `yaml:"patch"`
+}
+
+type openAPIOperation struct {
+	OperationID string                 `yaml:"operationId"`
+	Summary     string                 `yaml:"summary"`
+	Tags        []string               `yaml:"tags"`
+	Parameters  []openAPIParameter     `yaml:"parameters"`
+	RequestBody *openAPIRequestBody    `yaml:"requestBody"`
+	Responses   map[string]interface{} `yaml:"responses"`
+}
+
+type openAPIParameter struct {
+	Ref      string                    `yaml:"$ref"`
+	Name     string                    `yaml:"name"`
+	In       string                    `yaml:"in"`
+	Required bool                      `yaml:"required"`
+	Type     string                    `yaml:"type"`
+	Example  interface{}               `yaml:"example"`
+	XExample interface{}               `yaml:"x-example"`
+	Examples map[string]openAPIExample `yaml:"examples"`
+	Default  interface{}               `yaml:"default"`
+	Enum     []interface{}             `yaml:"enum"`
+	Schema   *openAPISchema            `yaml:"schema"`
+}
+
+type openAPIExample struct {
+	Value interface{} `yaml:"value"`
+}
+
+type openAPIRequestBody struct {
+	Ref     string                      `yaml:"$ref"`
+	Content map[string]openAPIMediaType `yaml:"content"`
+}
+
+type openAPIMediaType struct {
+	Example  interface{}               `yaml:"example"`
+	Examples map[string]openAPIExample `yaml:"examples"`
+	Schema   *openAPISchema            `yaml:"schema"`
+}
+
+type openAPISchema struct {
+	Ref        string                    `yaml:"$ref"`
+	Type       string                    `yaml:"type"`
+	Example    interface{}               `yaml:"example"`
+	Default    interface{}               `yaml:"default"`
+	Enum       []interface{}             `yaml:"enum"`
+	Properties map[string]*openAPISchema `yaml:"properties"`
+	Items      *openAPISchema            `yaml:"items"`
+	AllOf      []*openAPISchema          `yaml:"allOf"`
+}
+
+// NewManifestFromOpenAPI generates manifest with one interaction per
+// operation of OpenAPI 3.x or Swagger 2.0 specification (YAML or JSON)
+func NewManifestFromOpenAPI(r io.Reader, options OpenAPIOptions) (*Manifest, error) {
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+
+	spec := &openAPISpec{}
+	if err := yaml.Unmarshal(buf.Bytes(), spec); err != nil {
+		return nil, err
+	}
+	if spec.Swagger == "" && spec.OpenAPI == "" {
+		return nil, errors.New("document is not an OpenAPI or Swagger specification")
+	}
+
+	baseURL := strings.TrimRight(options.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = spec.baseURL()
+	}
+	if uri, err := url.Parse(baseURL); err != nil || !uri.IsAbs() {
+		return nil, fmt.Errorf("unable to determine absolute server URL from specification (got %q)", baseURL)
+	}
+
+	paths := make([]string, 0, len(spec.Paths))
+	for p := range spec.Paths {
+		if strings.HasPrefix(p, options.PathPrefix) {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	manifest := NewManifest()
+	manifest.Version = 1
+
+	for _, p := range paths {
+		item := spec.Paths[p]
+		for _, method := range openAPIMethods {
+			op := item.operation(method)
+			if op == nil || !op.hasAnyTag(options.Tags) {
+				continue
+			}
+
+			interaction, err := spec.interaction(baseURL, p, method, item, op)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %s", strings.ToUpper(method), p, err)
+			}
+			manifest.Interactions = append(manifest.Interactions, interaction)
+		}
+	}
+
+	return manifest, nil
+}
+
+func (s *openAPISpec) baseURL() string {
+	if len(s.Servers) > 0 {
+		server := s.Servers[0]
+		base := server.URL
+		for name, variable := range server.Variables {
+			base = strings.Replace(base, "{"+name+"}", variable.Default, -1)
+		}
+		return strings.TrimRight(base, "/")
+	}
+
+	if s.Host != "" {
+		scheme := "https"
+		if len(s.Schemes) > 0 {
+			scheme = s.Schemes[0]
+		}
+		return strings.TrimRight(fmt.Sprintf("%s://%s%s", scheme, s.Host, s.BasePath), "/")
+	}
+	return ""
+}
+
+func (s *openAPISpec) interaction(baseURL, p, method string, item openAPIPathItem, op *openAPIOperation) (RequestInteraction, error) {
+	interaction := RequestInteraction{
+		Name:       op.Summary,
+		Method:     method,
+		StatusCode: op.successCode(),
+		Tags:       op.Tags,
+		Headers:    http.Header{},
+	}
+	if interaction.Name == "" {
+		interaction.Name = op.OperationID
+	}
+	if interaction.Name == "" {
+		interaction.Name = fmt.Sprintf("%s %s", strings.ToUpper(method), p)
+	}
+
+	// operation parameters override path item ones
+	params := make(map[string]openAPIParameter)
+	var order []string
+	for _, param := range append(append([]openAPIParameter{}, item.Parameters...), op.Parameters...) {
+		param = s.resolveParameter(param)
+		key := param.In + ":" + param.Name
+		if _, found := params[key]; !found {
+			order = append(order, key)
+		}
+		params[key] = param
+	}
+
+	query := url.Values{}
+	form := url.Values{}
+	var body interface{}
+	for _, key := range order {
+		param := params[key]
+		value := s.parameterExample(param)
+
+		switch param.In {
+		case "path":
+			if value == nil {
+				value = s.placeholder(param)
+			}
+			p = strings.Replace(p, "{"+param.Name+"}", url.PathEscape(formatParameter(value)), -1)
+		case "query":
+			if value == nil && param.Required {
+				value = s.placeholder(param)
+			}
+			if value != nil {
+				query.Set(param.Name, formatParameter(value))
+			}
+		case "header":
+			if value != nil {
+				interaction.Headers.Set(param.Name, formatParameter(value))
+			}
+		case "formData":
+			if value == nil && param.Required {
+				value = s.placeholder(param)
+			}
+			if value != nil {
+				form.Set(param.Name, formatParameter(value))
+			}
+		case "body":
+			body = s.schemaExample(param.Schema, 0)
+			if param.Example != nil {
+				body = param.Example
+			}
+		}
+	}
+
+	interaction.URL = baseURL + p
+	if len(query) > 0 {
+		interaction.URL += "?" + query.Encode()
+	}
+
+	// swagger 2.0 request payloads
+	if body != nil {
+		payload, err := json.Marshal(normalizeYAML(body))
+		if err != nil {
+			return interaction, err
+		}
+		interaction.Payload = string(payload)
+		interaction.Headers.Set("Content-Type", "application/json")
+	} else if len(form) > 0 {
+		interaction.Payload = form.Encode()
+		interaction.Headers.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	// openapi 3.x request payloads
+	if op.RequestBody != nil {
+		contentType, payload, err := s.requestBodyExample(s.resolveRequestBody(*op.RequestBody))
+		if err != nil {
+			return interaction, err
+		}
+		if payload != "" {
+			interaction.Payload = payload
+			interaction.Headers.Set("Content-Type", contentType)
+		}
+	}
+
+	if len(interaction.Headers) == 0 {
+		interaction.Headers = nil
+	}
+	return interaction, nil
+}
+
+func (s *openAPISpec) requestBodyExample(rb openAPIRequestBody) (string, string, error) {
+	if len(rb.Content) == 0 {
+		return "", "", nil
+	}
+
+	contentType := "application/json"
+	media, found := rb.Content[contentType]
+	if !found {
+		var types []string
+		for t := range rb.Content {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		contentType = types[0]
+		media = rb.Content[contentType]
+	}
+
+	example := media.Example
+	if example == nil && len(media.Examples) > 0 {
+		example = media.Examples[sortedExampleKeys(media.Examples)[0]].Value
+	}
+	if example == nil {
+		example = s.schemaExample(media.Schema, 0)
+	}
+	if example == nil {
+		return contentType, "", nil
+	}
+
+	if text, ok := example.(string); ok && !strings.Contains(contentType, "json") {
+		return contentType, text, nil
+	}
+
+	if strings.Contains(contentType, "x-www-form-urlencoded") {
+		if fields, ok := normalizeYAML(example).(map[string]interface{}); ok {
+			form := url.Values{}
+			for k, v := range fields {
+				form.Set(k, formatParameter(v))
+			}
+			return contentType, form.Encode(), nil
+		}
+	}
+
+	payload, err := json.Marshal(normalizeYAML(example))
+	if err != nil {
+		return contentType, "", err
+	}
+	return contentType, string(payload), nil
+}
+
+func (s *openAPISpec) parameterExample(param openAPIParameter) interface{} {
+	if param.Example != nil {
+		return param.Example
+	}
+	if len(param.Examples) > 0 {
+		return param.Examples[sortedExampleKeys(param.Examples)[0]].Value
+	}
+	if param.XExample != nil {
+		return param.XExample
+	}
+	if param.Schema != nil {
+		schema := s.resolveSchema(param.Schema)
+		if schema.Example != nil {
+			return schema.Example
+		}
+		if schema.Default != nil {
+			return schema.Default
+		}
+		if len(schema.Enum) > 0 {
+			return schema.Enum[0]
+		}
+	}
+	if param.Default != nil {
+		return param.Default
+	}
+	if len(param.Enum) > 0 {
+		return param.Enum[0]
+	}
+	return nil
+}
+
+func (s *openAPISpec) placeholder(param openAPIParameter) interface{} {
+	kind := param.Type
+	if param.Schema != nil {
+		kind = s.resolveSchema(param.Schema).Type
+	}
+
+	switch kind {
+	case "integer", "number":
+		return 1
+	case "boolean":
+		return true
+	}
+	return param.Name
+}
+
+func (s *openAPISpec) schemaExample(schema *openAPISchema, depth int) interface{} {
+	schema = s.resolveSchema(schema)
+	if schema == nil || depth > 8 {
+		return nil
+	}
+
+	if schema.Example != nil {
+		return schema.Example
+	}
+	if schema.Default != nil {
+		return schema.Default
+	}
+	if len(schema.Enum) > 0 {
+		return schema.Enum[0]
+	}
+
+	if len(schema.AllOf) > 0 {
+		merged := make(map[string]interface{})
+		for _, child := range schema.AllOf {
+			if fields, ok := normalizeYAML(s.schemaExample(child, depth+1)).(map[string]interface{}); ok {
+				for k, v := range fields {
+					merged[k] = v
+				}
+			}
+		}
+		return merged
+	}
+
+	switch schema.Type {
+	case "array":
+		item := s.schemaExample(schema.Items, depth+1)
+		if item == nil {
+			return []interface{}{}
+		}
+		return []interface{}{item}
+	case "integer", "number":
+		return 0
+	case "boolean":
+		return false
+	case "string":
+		return "string"
+	}
+
+	if schema.Type == "object" || len(schema.Properties) > 0 {
+		fields := make(map[string]interface{})
+		for name, property := range schema.Properties {
+			fields[name] = s.schemaExample(property, depth+1)
+		}
+		return fields
+	}
+	return nil
+}
+
+func (s *openAPISpec) resolveParameter(param openAPIParameter) openAPIParameter {
+	if param.Ref == "" {
+		return param
+	}
+	name := refName(param.Ref)
+	if resolved, found := s.Components.Parameters[name]; found {
+		return resolved
+	}
+	if resolved, found := s.Parameters[name]; found {
+		return resolved
+	}
+	return param
+}
+
+func (s *openAPISpec) resolveRequestBody(rb openAPIRequestBody) openAPIRequestBody {
+	if rb.Ref == "" {
+		return rb
+	}
+	if resolved, found := s.Components.RequestBodies[refName(rb.Ref)]; found {
+		return resolved
+	}
+	return rb
+}
+
+func (s *openAPISpec) resolveSchema(schema *openAPISchema) *openAPISchema {
+	// guards against circular references
+	for i := 0; schema != nil && schema.Ref != "" && i < 8; i++ {
+		name := refName(schema.Ref)
+		if resolved, found := s.Components.Schemas[name]; found {
+			schema = resolved
+		} else if resolved, found := s.Definitions[name]; found {
+			schema = resolved
+		} else {
+			return nil
+		}
+	}
+	return schema
+}
+
+func (pi openAPIPathItem) operation(method string) *openAPIOperation {
+	switch method {
+	case "get":
+		return pi.Get
+	case "put":
+		return pi.Put
+	case "post":
+		return pi.Post
+	case "delete":
+		return pi.Delete
+	case "options":
+		return pi.Options
+	case "head":
+		return pi.Head
+	case "patch":
+		return pi.Patch
+	}
+	return nil
+}
+
+func (op *openAPIOperation) hasAnyTag(tags []string) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	for _, tag := range tags {
+		for _, opTag := range op.Tags {
+			if tag == opTag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (op *openAPIOperation) successCode() int {
+	var codes []int
+	for code := range op.Responses {
+		if n, err := strconv.Atoi(code); err == nil {
+			codes = append(codes, n)
+		}
+	}
+	sort.Ints(codes)
+
+	for _, code := range codes {
+		if code >= 200 && code < 300 {
+			return code
+		}
+	}
+	return 0
+}
+
+func refName(ref string) string {
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+func sortedExampleKeys(examples map[string]openAPIExample) []string {
+	keys := make([]string, 0, len(examples))
+	for k := range examples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatParameter(value interface{}) string {
+	if values, ok := value.([]interface{}); ok {
+		parts := make([]string, len(values))
+		for i, v := range values {
+			parts[i] = fmt.Sprint(v)
+		}
+		return strings.Join(parts, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// normalizeYAML converts maps decoded from YAML into JSON compatible ones
+func normalizeYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			result[fmt.Sprint(k)] = normalizeYAML(child)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			result[k] = normalizeYAML(child)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, child := range v {
+			result[i] = normalizeYAML(child)
+		}
+		return result
+	}
+	return value
+}
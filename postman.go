@@ -0,0 +1,403 @@
+package apidiff
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// boundary of generated multipart payloads is fixed so that
+// fingerprints of imported interactions are stable
+const multipartBoundary = "apidiff-boundary"
+
+var postmanVariablePattern = regexp.MustCompile(`{{\s*([^{}\s]+)\s*}}`)
+
+type postmanCollection struct {
+	Info struct {
+		Name   string `json:"name"`
+		Schema string `json:"schema"`
+	} `json:"info"`
+	Item     []postmanItem     `json:"item"`
+	Variable []postmanKeyValue `json:"variable"`
+	Auth     *postmanAuth      `json:"auth"`
+
+	// requests imported without their authorization
+	warnings []string
+}
+
+type postmanItem struct {
+	Name    string          `json:"name"`
+	Item    []postmanItem   `json:"item"`
+	Request *postmanRequest `json:"request"`
+	Auth    *postmanAuth    `json:"auth"`
+}
+
+type postmanRequest struct {
+	Method string            `json:"method"`
+	Header []postmanKeyValue `json:"header"`
+	Body   *postmanBody      `json:"body"`
+	URL    postmanURL        `json:"url"`
+	Auth   *postmanAuth      `json:"auth"`
+}
+
+type postmanURL struct {
+	Raw      string            `json:"raw"`
+	Protocol string            `json:"protocol"`
+	Host     []string          `json:"host"`
+	Path     []string          `json:"path"`
+	Query    []postmanKeyValue `json:"query"`
+}
+
+type postmanBody struct {
+	Mode       string            `json:"mode"`
+	Raw        string            `json:"raw"`
+	URLEncoded []postmanKeyValue `json:"urlencoded"`
+	FormData   []postmanKeyValue `json:"formdata"`
+	GraphQL    *struct {
+		Query     string `json:"query"`
+		Variables string `json:"variables"`
+	} `json:"graphql"`
+	Options struct {
+		Raw struct {
+			Language string `json:"language"`
+		} `json:"raw"`
+	} `json:"options"`
+}
+
+type postmanAuth struct {
+	Type   string            `json:"type"`
+	Basic  []postmanKeyValue `json:"basic"`
+	Bearer []postmanKeyValue `json:"bearer"`
+	APIKey []postmanKeyValue `json:"apikey"`
+}
+
+type postmanKeyValue struct {
+	Key      string      `json:"key"`
+	Value    interface{} `json:"value"`
+	Type     string      `json:"type"`
+	Disabled bool        `json:"disabled"`
+}
+
+type multipartField struct {
+	Name  string
+	Value string
+}
+
+// UnmarshalJSON accepts request defined as plain URL string
+func (r *postmanRequest) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err == nil {
+		r.Method = "GET"
+		r.URL = postmanURL{Raw: raw}
+		return nil
+	}
+
+	type request postmanRequest
+	return json.Unmarshal(data, (*request)(r))
+}
+
+// UnmarshalJSON accepts URL defined as plain string
+func (u *postmanURL) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err == nil {
+		u.Raw = raw
+		return nil
+	}
+
+	type postmanURLObject postmanURL
+	return json.Unmarshal(data, (*postmanURLObject)(u))
+}
+
+// NewManifestFromPostman converts Postman Collection v2.1 into manifest
+// interactions, collection variables can be overridden by variables.
+// Requests using unsupported authorization are imported without it and
+// reported by returned warnings.
+func NewManifestFromPostman(r io.Reader, variables map[string]string) (*Manifest, []string, error) {
+	collection := &postmanCollection{}
+	if err := json.NewDecoder(r).Decode(collection); err != nil {
+		return nil, nil, err
+	}
+	if len(collection.Item) == 0 && collection.Info.Name == "" {
+		return nil, nil, errors.New("document is not a Postman collection")
+	}
+
+	vars := make(map[string]string)
+	for _, variable := range collection.Variable {
+		if !variable.Disabled {
+			vars[variable.Key] = variable.value()
+		}
+	}
+	for k, v := range variables {
+		vars[k] = v
+	}
+
+	manifest := NewManifest()
+	manifest.Version = 1
+
+	err := collection.addItems(manifest, collection.Item, "", collection.Auth, vars)
+	if err != nil {
+		return nil, nil, err
+	}
+	return manifest, collection.warnings, nil
+}
+
+func (c *postmanCollection) addItems(manifest *Manifest, items []postmanItem, folder string, auth *postmanAuth, vars map[string]string) error {
+	for _, item := range items {
+		name := item.Name
+		if folder != "" {
+			name = folder + " / " + item.Name
+		}
+
+		// folders and requests inherit authorization of their parent
+		itemAuth := auth
+		if !item.Auth.inherited() {
+			itemAuth = item.Auth
+		}
+
+		if item.Request == nil {
+			if err := c.addItems(manifest, item.Item, name, itemAuth, vars); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !item.Request.Auth.inherited() {
+			itemAuth = item.Request.Auth
+		}
+		if itemAuth != nil && !itemAuth.supported() {
+			c.warnings = append(c.warnings, fmt.Sprintf("%s: unsupported authorization type %q, request is imported without authorization", name, itemAuth.Type))
+			itemAuth = nil
+		}
+
+		interaction, err := item.Request.interaction(itemAuth, vars)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		interaction.Name = name
+		manifest.Interactions = append(manifest.Interactions, interaction)
+	}
+	return nil
+}
+
+func (r *postmanRequest) interaction(auth *postmanAuth, vars map[string]string) (RequestInteraction, error) {
+	method := r.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	interaction := RequestInteraction{
+		Method:  strings.ToLower(method),
+		Headers: http.Header{},
+	}
+
+	rawURL := r.URL.raw()
+	uri, err := url.Parse(substituteVariables(rawURL, vars))
+	if err != nil {
+		return interaction, err
+	}
+	if uri.Scheme == "" {
+		uri, err = url.Parse("http://" + substituteVariables(rawURL, vars))
+		if err != nil {
+			return interaction, err
+		}
+	}
+
+	for _, header := range r.Header {
+		if !header.Disabled {
+			interaction.Headers.Add(
+				substituteVariables(header.Key, vars),
+				substituteVariables(header.value(), vars),
+			)
+		}
+	}
+
+	if auth != nil {
+		if err := auth.apply(interaction.Headers, uri, vars); err != nil {
+			return interaction, err
+		}
+	}
+	interaction.URL = uri.String()
+
+	if r.Body != nil {
+		contentType, payload, err := r.Body.payload(vars)
+		if err != nil {
+			return interaction, err
+		}
+		interaction.Payload = payload
+		if contentType != "" && interaction.Headers.Get("Content-Type") == "" {
+			interaction.Headers.Set("Content-Type", contentType)
+		}
+	}
+
+	if len(interaction.Headers) == 0 {
+		interaction.Headers = nil
+	}
+	return interaction, nil
+}
+
+func (u postmanURL) raw() string {
+	if u.Raw != "" {
+		return u.Raw
+	}
+
+	raw := strings.Join(u.Host, ".")
+	if u.Protocol != "" {
+		raw = u.Protocol + "://" + raw
+	}
+	if len(u.Path) > 0 {
+		raw += "/" + strings.Join(u.Path, "/")
+	}
+
+	var query []string
+	for _, param := range u.Query {
+		if !param.Disabled {
+			query = append(query, param.Key+"="+param.value())
+		}
+	}
+	if len(query) > 0 {
+		raw += "?" + strings.Join(query, "&")
+	}
+	return raw
+}
+
+func (b *postmanBody) payload(vars map[string]string) (string, string, error) {
+	switch b.Mode {
+	case "raw":
+		contentType := ""
+		switch b.Options.Raw.Language {
+		case "json":
+			contentType = "application/json"
+		case "xml":
+			contentType = "application/xml"
+		}
+		return contentType, substituteVariables(b.Raw, vars), nil
+	case "urlencoded":
+		form := url.Values{}
+		for _, field := range b.URLEncoded {
+			if !field.Disabled {
+				form.Add(substituteVariables(field.Key, vars), substituteVariables(field.value(), vars))
+			}
+		}
+		return "application/x-www-form-urlencoded", form.Encode(), nil
+	case "formdata":
+		var fields []multipartField
+		for _, field := range b.FormData {
+			if field.Disabled {
+				continue
+			}
+			if field.Type == "file" {
+				return "", "", fmt.Errorf("file form field %q is not supported", field.Key)
+			}
+			fields = append(fields, multipartField{
+				Name:  substituteVariables(field.Key, vars),
+				Value: substituteVariables(field.value(), vars),
+			})
+		}
+		return multipartBody(fields)
+	case "graphql":
+		if b.GraphQL == nil {
+			return "", "", nil
+		}
+		query := map[string]interface{}{
+			"query": substituteVariables(b.GraphQL.Query, vars),
+		}
+		if variables := strings.TrimSpace(substituteVariables(b.GraphQL.Variables, vars)); variables != "" {
+			query["variables"] = json.RawMessage(variables)
+		}
+		payload, err := json.Marshal(query)
+		return "application/json", string(payload), err
+	}
+	return "", "", nil
+}
+
+// inherited reports whether authorization of parent is used
+func (a *postmanAuth) inherited() bool {
+	return a == nil || a.Type == "inherit"
+}
+
+func (a *postmanAuth) supported() bool {
+	switch a.Type {
+	case "", "noauth", "basic", "bearer", "apikey":
+		return true
+	}
+	return false
+}
+
+func (a *postmanAuth) apply(headers http.Header, uri *url.URL, vars map[string]string) error {
+	switch a.Type {
+	case "", "noauth":
+	case "basic":
+		credentials := fmt.Sprintf("%s:%s",
+			substituteVariables(postmanParam(a.Basic, "username"), vars),
+			substituteVariables(postmanParam(a.Basic, "password"), vars),
+		)
+		headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	case "bearer":
+		headers.Set("Authorization", "Bearer "+substituteVariables(postmanParam(a.Bearer, "token"), vars))
+	case "apikey":
+		key := substituteVariables(postmanParam(a.APIKey, "key"), vars)
+		value := substituteVariables(postmanParam(a.APIKey, "value"), vars)
+		if postmanParam(a.APIKey, "in") == "query" {
+			query := uri.Query()
+			query.Set(key, value)
+			uri.RawQuery = query.Encode()
+		} else {
+			headers.Set(key, value)
+		}
+	default:
+		return fmt.Errorf("unsupported authorization type %q", a.Type)
+	}
+	return nil
+}
+
+func (kv postmanKeyValue) value() string {
+	if kv.Value == nil {
+		return ""
+	}
+	return fmt.Sprint(kv.Value)
+}
+
+func postmanParam(params []postmanKeyValue, key string) string {
+	for _, param := range params {
+		if param.Key == key {
+			return param.value()
+		}
+	}
+	return ""
+}
+
+func substituteVariables(value string, vars map[string]string) string {
+	return postmanVariablePattern.ReplaceAllStringFunc(value, func(match string) string {
+		name := postmanVariablePattern.FindStringSubmatch(match)[1]
+		if v, found := vars[name]; found {
+			return v
+		}
+		return match
+	})
+}
+
+func multipartBody(fields []multipartField) (string, string, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if err := writer.SetBoundary(multipartBoundary); err != nil {
+		return "", "", err
+	}
+
+	for _, field := range fields {
+		if err := writer.WriteField(field.Name, field.Value); err != nil {
+			return "", "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", "", err
+	}
+	return writer.FormDataContentType(), body.String(), nil
+}
@@ -0,0 +1,372 @@
+package apidiff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dnaeon/go-vcr/cassette"
+)
+
+// RedactedPlaceholder replaces redacted values in stored interactions, it
+// is always the same so redacted values never show up as differences
+const RedactedPlaceholder = "[REDACTED]"
+
+// RedactOptions selects values replaced by RedactedPlaceholder before
+// interactions are stored
+type RedactOptions struct {
+	// Defaults extends options by DefaultRedaction, enabled when not set
+	Defaults *bool `yaml:"defaults,omitempty"`
+	// Headers of requests and responses, cookies and authorization
+	// schemes keep their names
+	Headers []string `yaml:"headers,omitempty"`
+	// Query parameters of URL and fields of form bodies
+	Query []string `yaml:"query,omitempty"`
+	// JSON paths of request and response bodies, keys are separated by
+	// dots, * matches any key or array element and ** any depth
+	JSON []string `yaml:"json,omitempty"`
+	// Patterns are regular expressions replaced in URL, headers and
+	// bodies, only submatches are replaced when pattern has any
+	Patterns []string `yaml:"patterns,omitempty"`
+}
+
+// DefaultRedaction returns redaction of common credentials that is used
+// unless manifest disables it
+func DefaultRedaction() RedactOptions {
+	return RedactOptions{
+		Headers: []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "X-Auth-Token"},
+		Query:   []string{"access_token", "api_key", "apikey", "client_secret", "password", "refresh_token"},
+		JSON:    []string{"**.password", "**.access_token", "**.refresh_token", "**.id_token", "**.client_secret", "**.api_key"},
+	}
+}
+
+// redactRule replaces secrets of stored interactions by placeholder
+type redactRule struct {
+	name     string
+	headers  map[string]bool
+	query    map[string]bool
+	json     [][]string
+	patterns []*regexp.Regexp
+}
+
+func newRedactRule(value interface{}) (Rule, error) {
+	var options RedactOptions
+	if err := DecodeRuleValue(value, &options); err != nil {
+		return nil, err
+	}
+	return compileRedaction(options)
+}
+
+func compileRedaction(options RedactOptions) (redactRule, error) {
+	if options.Defaults == nil || *options.Defaults {
+		defaults := DefaultRedaction()
+		options.Headers = append(defaults.Headers, options.Headers...)
+		options.Query = append(defaults.Query, options.Query...)
+		options.JSON = append(defaults.JSON, options.JSON...)
+		options.Patterns = append(defaults.Patterns, options.Patterns...)
+	}
+
+	r := redactRule{
+		name:    "redact",
+		headers: make(map[string]bool),
+		query:   make(map[string]bool),
+	}
+	for _, header := range options.Headers {
+		r.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	for _, key := range options.Query {
+		r.query[strings.ToLower(key)] = true
+	}
+	for _, path := range options.JSON {
+		segments, err := parseJSONPath(path)
+		if err != nil {
+			return r, err
+		}
+		r.json = append(r.json, segments)
+	}
+	for _, pattern := range options.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return r, fmt.Errorf("invalid pattern %q - %s", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// parseJSONPath splits path into keys, optional $ root is dropped
+func parseJSONPath(path string) ([]string, error) {
+	trimmed := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	segments := strings.Split(trimmed, ".")
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, fmt.Errorf("invalid JSON path %q", path)
+		}
+	}
+	if segments[len(segments)-1] == "**" {
+		return nil, fmt.Errorf("JSON path %q has to end with a key", path)
+	}
+	return segments, nil
+}
+
+func (r redactRule) Name() string {
+	return r.name
+}
+
+func (r redactRule) FilterStorage(ci *cassette.Interaction) error {
+	uri, err := r.redactURL(ci.Request.URL)
+	if err != nil {
+		return err
+	}
+	ci.Request.URL = uri
+	ci.Request.Headers = r.redactHeaders(ci.Request.Headers)
+	ci.Request.Form = r.redactForm(ci.Request.Form)
+	ci.Request.Body = r.redactBody(ci.Request.Body, ci.Request.Headers)
+
+	ci.Response.Headers = r.redactHeaders(ci.Response.Headers)
+	ci.Response.Body = r.redactBody(ci.Response.Body, ci.Response.Headers)
+	return nil
+}
+
+func (r redactRule) redactURL(rawURL string) (string, error) {
+	uri, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	// query is encoded again only when it changed to keep URL as it was
+	if query := uri.Query(); len(query) > 0 {
+		if redacted := r.redactForm(query); !equalForms(query, redacted) {
+			uri.RawQuery = redacted.Encode()
+		}
+	}
+	return r.redactPatterns(uri.String()), nil
+}
+
+func (r redactRule) redactHeaders(headers http.Header) http.Header {
+	if headers == nil {
+		return nil
+	}
+
+	redacted := make(http.Header, len(headers))
+	for key, values := range headers {
+		canonical := http.CanonicalHeaderKey(key)
+		for _, value := range values {
+			if r.headers[canonical] {
+				value = redactHeaderValue(canonical, value)
+			}
+			redacted[key] = append(redacted[key], r.redactPatterns(value))
+		}
+	}
+	return redacted
+}
+
+// redactHeaderValue keeps names of cookies and authorization scheme so
+// redacted headers remain readable
+func redactHeaderValue(header, value string) string {
+	switch header {
+	case "Set-Cookie":
+		parts := strings.SplitN(value, ";", 2)
+		parts[0] = redactCookie(parts[0])
+		return strings.Join(parts, ";")
+	case "Cookie":
+		cookies := strings.Split(value, ";")
+		for i := range cookies {
+			cookies[i] = redactCookie(cookies[i])
+		}
+		return strings.Join(cookies, ";")
+	case "Authorization", "Proxy-Authorization":
+		if i := strings.Index(value, " "); i > 0 {
+			return value[:i+1] + RedactedPlaceholder
+		}
+	}
+	return RedactedPlaceholder
+}
+
+func redactCookie(cookie string) string {
+	i := strings.Index(cookie, "=")
+	if i < 0 {
+		return RedactedPlaceholder
+	}
+	return cookie[:i+1] + RedactedPlaceholder
+}
+
+func (r redactRule) redactForm(form url.Values) url.Values {
+	if form == nil {
+		return nil
+	}
+
+	redacted := make(url.Values, len(form))
+	for key, values := range form {
+		values = append([]string(nil), values...)
+		if r.query[strings.ToLower(key)] {
+			for i := range values {
+				values[i] = RedactedPlaceholder
+			}
+		}
+		redacted[key] = values
+	}
+	return redacted
+}
+
+func (r redactRule) redactBody(body string, headers http.Header) string {
+	if body == "" {
+		return body
+	}
+
+	mediaType := headers.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(mediaType, "application/x-www-form-urlencoded"):
+		if form, err := url.ParseQuery(body); err == nil {
+			if redacted := r.redactForm(form); !equalForms(form, redacted) {
+				body = redacted.Encode()
+			}
+		}
+	case len(r.json) > 0:
+		if redacted, err := r.redactJSON(body); err == nil {
+			body = redacted
+		}
+	}
+	return r.redactPatterns(body)
+}
+
+// redactJSON returns body untouched unless any path matches, an error
+// is returned for bodies that are not JSON documents
+func (r redactRule) redactJSON(body string) (string, error) {
+	trimmed := strings.TrimSpace(body)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return "", errors.New("not a JSON document")
+	}
+
+	var document interface{}
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return "", err
+	}
+
+	changed := false
+	for _, path := range r.json {
+		var redacted bool
+		document, redacted = redactJSONPath(document, path)
+		changed = changed || redacted
+	}
+	if !changed {
+		return body, nil
+	}
+
+	return marshalJSON(document)
+}
+
+func redactJSONPath(value interface{}, path []string) (interface{}, bool) {
+	if len(path) == 0 {
+		return RedactedPlaceholder, true
+	}
+
+	changed := false
+	if path[0] == "**" {
+		// ** matches at current level as well as at any level below
+		value, changed = redactJSONPath(value, path[1:])
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, child := range v {
+				var redacted bool
+				v[key], redacted = redactJSONPath(child, path)
+				changed = changed || redacted
+			}
+		case []interface{}:
+			for i, child := range v {
+				var redacted bool
+				v[i], redacted = redactJSONPath(child, path)
+				changed = changed || redacted
+			}
+		}
+		return value, changed
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if path[0] == "*" || strings.EqualFold(path[0], key) {
+				var redacted bool
+				v[key], redacted = redactJSONPath(child, path[1:])
+				changed = changed || redacted
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				var redacted bool
+				v[i], redacted = redactJSONPath(child, path[1:])
+				changed = changed || redacted
+			}
+		}
+	}
+	return value, changed
+}
+
+func (r redactRule) redactPatterns(value string) string {
+	for _, re := range r.patterns {
+		if re.NumSubexp() == 0 {
+			value = re.ReplaceAllLiteralString(value, RedactedPlaceholder)
+			continue
+		}
+
+		var b strings.Builder
+		last := 0
+		for _, match := range re.FindAllStringSubmatchIndex(value, -1) {
+			for i := 2; i < len(match); i += 2 {
+				if match[i] < last {
+					continue
+				}
+				b.WriteString(value[last:match[i]])
+				b.WriteString(RedactedPlaceholder)
+				last = match[i+1]
+			}
+		}
+		b.WriteString(value[last:])
+		value = b.String()
+	}
+	return value
+}
+
+func equalForms(a, b url.Values) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range a {
+		if strings.Join(a[key], "&") != strings.Join(b[key], "&") {
+			return false
+		}
+	}
+	return true
+}
+
+// copyInteraction returns copy of interaction that can be modified
+// without affecting the original
+func copyInteraction(ci *cassette.Interaction) *cassette.Interaction {
+	copied := *ci
+	copied.Request.Headers = copyHeader(ci.Request.Headers)
+	copied.Response.Headers = copyHeader(ci.Response.Headers)
+	if ci.Request.Form != nil {
+		copied.Request.Form = url.Values(copyHeader(http.Header(ci.Request.Form)))
+	}
+	return &copied
+}
+
+func copyHeader(header http.Header) http.Header {
+	if header == nil {
+		return nil
+	}
+
+	copied := make(http.Header, len(header))
+	for key, values := range header {
+		copied[key] = append([]string(nil), values...)
+	}
+	return copied
+}
@@ -0,0 +1,95 @@
+package apidiff
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/dnaeon/go-vcr/cassette"
+)
+
+// defaultMaxRedirects matches limit of net/http client
+const defaultMaxRedirects = 10
+
+// RedirectPolicy controls redirects of recorded requests, every followed
+// redirect is recorded and compared as part of interaction
+type RedirectPolicy struct {
+	// Follow redirects, enabled when not set
+	Follow *bool `yaml:"follow,omitempty"`
+	// Max number of followed redirects, a redirect beyond it is recorded
+	// as the response
+	Max int `yaml:"max,omitempty"`
+}
+
+// Validate checks that maximum number of redirects is not negative
+func (rp *RedirectPolicy) Validate() error {
+	if rp.Max < 0 {
+		return errors.New("redirects max can not be negative")
+	}
+	return nil
+}
+
+// checkRedirect implements http.Client CheckRedirect, default policy is
+// used when nil
+func (rp *RedirectPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	max := defaultMaxRedirects
+	if rp != nil {
+		if rp.Follow != nil && !*rp.Follow {
+			return http.ErrUseLastResponse
+		}
+		if rp.Max > 0 {
+			max = rp.Max
+		}
+	}
+
+	if len(via) > max {
+		return http.ErrUseLastResponse
+	}
+	return nil
+}
+
+// compareRedirects compares status codes and locations of redirects
+// leading to final responses, differences are keyed by redirect number
+func compareRedirects(source, target []*cassette.Interaction) map[string]error {
+	differences := make(map[string]error)
+
+	sourceChain := redirectChain(source)
+	targetChain := redirectChain(target)
+	for i := 0; i < len(sourceChain) || i < len(targetChain); i++ {
+		key := strconv.Itoa(i + 1)
+		switch {
+		case i >= len(targetChain):
+			differences[key] = fmt.Errorf("redirect %s is missing", sourceChain[i])
+		case i >= len(sourceChain):
+			differences[key] = fmt.Errorf("unexpected redirect %s", targetChain[i])
+		case sourceChain[i] != targetChain[i]:
+			differences[key] = fmt.Errorf("expect %s but got %s", sourceChain[i], targetChain[i])
+		}
+	}
+	return differences
+}
+
+// redirectChain describes every exchange but the final one by status
+// code and location, locations on the same host are relative so that
+// chains of different hosts can be compared
+func redirectChain(interactions []*cassette.Interaction) []string {
+	var chain []string
+	for i := 0; i+1 < len(interactions); i++ {
+		resp := interactions[i].Response
+		location := resp.Headers.Get("Location")
+
+		requestURL, err := url.Parse(interactions[i].Request.URL)
+		if err == nil {
+			if uri, err := requestURL.Parse(location); err == nil {
+				location = uri.String()
+				if uri.Host == requestURL.Host {
+					location = uri.RequestURI()
+				}
+			}
+		}
+		chain = append(chain, fmt.Sprintf("%d %s", resp.Code, location))
+	}
+	return chain
+}
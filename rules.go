@@ -0,0 +1,201 @@
+package apidiff
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/dnaeon/go-vcr/cassette"
+	"gopkg.in/yaml.v2"
+)
+
+// Rule is a typed matching rule created from matching_rules entry of
+// manifest. A rule takes effect by implementing any of RequestMatcher,
+// RecordingFilter and ComparisonFilter.
+type Rule interface {
+	Name() string
+}
+
+// RequestMatcher decides whether request matches recorded request, the
+// first matcher of manifest replaces the default one
+type RequestMatcher interface {
+	MatchRequest(r *http.Request, recorded cassette.Request) bool
+}
+
+// RecordingFilter modifies interaction before it is stored or replayed
+type RecordingFilter interface {
+	FilterRecording(interaction *cassette.Interaction) error
+}
+
+// StorageFilter modifies copy of interaction just before it is stored,
+// the exchange seen by the client is not affected
+type StorageFilter interface {
+	FilterStorage(interaction *cassette.Interaction) error
+}
+
+// ComparisonFilter removes differences of compared interactions that
+// are expected
+type ComparisonFilter interface {
+	FilterDifferences(source, target *cassette.Interaction, differences *Differences)
+}
+
+// RuleFactory creates rule from YAML value of matching rule, an error is
+// returned when value does not match schema of the rule
+type RuleFactory func(value interface{}) (Rule, error)
+
+var ruleRegistry = struct {
+	sync.RWMutex
+	factories map[string]RuleFactory
+}{
+	factories: map[string]RuleFactory{
+		"match":          newMatchRule,
+		"match_url":      newMatchURLRule,
+		"ignore_headers": newIgnoreHeadersRule,
+		"redact":         newRedactRule,
+	},
+}
+
+// RegisterRule makes matching rule of given name available to manifests
+func RegisterRule(name string, factory RuleFactory) error {
+	if name == "" || factory == nil {
+		return errors.New("rule has to have a name and a factory")
+	}
+
+	ruleRegistry.Lock()
+	defer ruleRegistry.Unlock()
+
+	if _, found := ruleRegistry.factories[name]; found {
+		return fmt.Errorf("rule %q is already registered", name)
+	}
+	ruleRegistry.factories[name] = factory
+	return nil
+}
+
+// RegisteredRules returns sorted names of available matching rules
+func RegisteredRules() []string {
+	ruleRegistry.RLock()
+	defer ruleRegistry.RUnlock()
+
+	var names []string
+	for name := range ruleRegistry.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DecodeRuleValue decodes YAML value of matching rule into schema, keys
+// unknown to schema are rejected
+func DecodeRuleValue(value interface{}, schema interface{}) error {
+	if value == nil {
+		return errors.New("missing value")
+	}
+
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(data, schema)
+}
+
+// Rule returns typed rule, nil is returned for rules that are not
+// registered
+func (mr MatchingRules) Rule() (Rule, error) {
+	ruleRegistry.RLock()
+	factory, found := ruleRegistry.factories[mr.Name]
+	ruleRegistry.RUnlock()
+	if !found {
+		return nil, nil
+	}
+
+	rule, err := factory(mr.Value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value of rule %q - %s", mr.Name, err)
+	}
+	return rule, nil
+}
+
+// requestMatchers returns indexes of rules matching requests, only the
+// first one is used
+func requestMatchers(rules []MatchingRules) []int {
+	var indexes []int
+	for i, mr := range rules {
+		rule, err := mr.Rule()
+		if err != nil || rule == nil {
+			continue
+		}
+		if _, ok := rule.(RequestMatcher); ok {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// mergeRules returns base rules extended by overrides, an override
+// replaces base rule of the same name
+func mergeRules(base, overrides []MatchingRules) []MatchingRules {
+	if len(overrides) == 0 {
+		return base
+	}
+
+	merged := append([]MatchingRules(nil), base...)
+	for _, rule := range overrides {
+		replaced := false
+		for i := range merged {
+			if merged[i].Name == rule.Name {
+				merged[i] = rule
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, rule)
+		}
+	}
+	return merged
+}
+
+// compileRules creates typed rules skipping unknown ones
+func compileRules(rules []MatchingRules) ([]Rule, error) {
+	var compiled []Rule
+	for _, mr := range rules {
+		rule, err := mr.Rule()
+		if err != nil {
+			return nil, err
+		}
+		if rule != nil {
+			compiled = append(compiled, rule)
+		}
+	}
+	return compiled, nil
+}
+
+// ignoreHeadersRule drops headers from recorded requests and ignores
+// them in compared responses
+type ignoreHeadersRule []string
+
+func newIgnoreHeadersRule(value interface{}) (Rule, error) {
+	var headers []string
+	if err := DecodeRuleValue(value, &headers); err != nil {
+		return nil, err
+	}
+	return ignoreHeadersRule(headers), nil
+}
+
+func (r ignoreHeadersRule) Name() string {
+	return "ignore_headers"
+}
+
+func (r ignoreHeadersRule) FilterRecording(ci *cassette.Interaction) error {
+	for _, header := range r {
+		delete(ci.Request.Headers, header)
+	}
+	return nil
+}
+
+func (r ignoreHeadersRule) FilterDifferences(source, target *cassette.Interaction, differences *Differences) {
+	for _, header := range r {
+		delete(differences.Headers, header)
+	}
+}
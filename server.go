@@ -0,0 +1,264 @@
+package apidiff
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dnaeon/go-vcr/cassette"
+)
+
+// UnmatchedBehavior defines how replay server handles requests that are
+// not present in a recorded session
+type UnmatchedBehavior string
+
+const (
+	// UnmatchedNotFound responds with 404 Not Found
+	UnmatchedNotFound UnmatchedBehavior = "404"
+	// UnmatchedPassthrough forwards request to the upstream API
+	UnmatchedPassthrough UnmatchedBehavior = "passthrough"
+	// UnmatchedFail responds with an error and stops the server
+	UnmatchedFail UnmatchedBehavior = "fail"
+)
+
+// ServeOptions holds replay server settings
+type ServeOptions struct {
+	Unmatched UnmatchedBehavior
+	Latency   bool
+	Upstream  string
+}
+
+// ReplayHandler answers HTTP requests from recorded session cassettes
+type ReplayHandler struct {
+	ad           *APIDiff
+	options      ServeOptions
+	matcher      cassette.Matcher
+	interactions []replayInteraction
+	upstream     *httputil.ReverseProxy
+	failures     chan error
+}
+
+type replayInteraction struct {
+	interaction *cassette.Interaction
+	url         *url.URL
+	stats       RequestStats
+}
+
+// NewReplayHandler loads recorded session and returns HTTP handler
+// replaying its interactions
+func (ad *APIDiff) NewReplayHandler(name string, rules []MatchingRules, options ServeOptions) (*ReplayHandler, error) {
+	switch options.Unmatched {
+	case "":
+		options.Unmatched = UnmatchedNotFound
+	case UnmatchedNotFound, UnmatchedPassthrough, UnmatchedFail:
+	default:
+		return nil, fmt.Errorf("unknown unmatched request behavior %q", options.Unmatched)
+	}
+
+	metadata, err := ad.metadata(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(metadata.Versions) == 0 {
+		return nil, fmt.Errorf("Unable to find session %q", name)
+	}
+	version := metadata.version(metadata.CurrentVersion())
+	key := versionKey(name, version.Version)
+
+	fingerprints, err := ad.Storage.Interactions(key)
+	if err != nil {
+		return nil, err
+	}
+
+	compiled, err := compileRules(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := &ReplayHandler{
+		ad:       ad,
+		options:  options,
+		matcher:  ad.createMatcher(compiled),
+		failures: make(chan error, 1),
+	}
+
+	// apply the same filter as was used while recording
+	filter := ad.createFilter(compiled)
+	for _, fingerprint := range fingerprints {
+		if !ad.Options.Selection.Match(version.Tags[fingerprint]) {
+			continue
+		}
+
+		stored, err := ad.Storage.LoadInteraction(key, fingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		// latency is optional so missing stats are not fatal
+		var stats RequestStats
+		if stored.Stats != nil {
+			stats = *stored.Stats
+		}
+
+		// followed redirects are replayed so clients can follow them too
+		for i, interaction := range stored.Interactions {
+			if err = filter(interaction); err != nil {
+				return nil, err
+			}
+
+			uri, err := url.Parse(interaction.Request.URL)
+			if err != nil {
+				return nil, err
+			}
+
+			ri := replayInteraction{
+				interaction: interaction,
+				url:         uri,
+			}
+			if i == 0 {
+				ri.stats = stats
+			}
+			handler.interactions = append(handler.interactions, ri)
+		}
+	}
+
+	if options.Unmatched == UnmatchedPassthrough {
+		upstream := options.Upstream
+		if upstream == "" && len(handler.interactions) > 0 {
+			uri := handler.interactions[0].url
+			upstream = fmt.Sprintf("%s://%s", uri.Scheme, uri.Host)
+		}
+		if !ad.isValidURL(upstream) {
+			return nil, fmt.Errorf("invalid upstream URL %q", upstream)
+		}
+
+		target, err := url.Parse(upstream)
+		if err != nil {
+			return nil, err
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		director := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			director(r)
+			r.Host = target.Host
+		}
+		handler.upstream = proxy
+	}
+
+	return handler, nil
+}
+
+// ServeHTTP implements http.Handler interface
+func (h *ReplayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ri := h.match(r)
+	if ri == nil {
+		h.serveUnmatched(w, r)
+		return
+	}
+
+	if h.options.Latency {
+		time.Sleep(time.Duration(ri.stats.Duration()) * time.Millisecond)
+	}
+
+	resp := ri.interaction.Response
+	for headerKey, headerValue := range resp.Headers {
+		// length is computed from replayed body
+		if strings.EqualFold(headerKey, "Content-Length") {
+			continue
+		}
+		for _, childHeaderValue := range headerValue {
+			w.Header().Add(headerKey, childHeaderValue)
+		}
+	}
+	w.WriteHeader(resp.Code)
+	fmt.Fprint(w, resp.Body)
+
+	if h.ad.Options.Verbose {
+		fmt.Printf("Replayed %s %q with status: %s\n", r.Method, r.URL, resp.Status)
+	}
+}
+
+// Failures returns channel of unmatched requests errors when using
+// UnmatchedFail behavior
+func (h *ReplayHandler) Failures() <-chan error {
+	return h.failures
+}
+
+func (h *ReplayHandler) match(r *http.Request) *replayInteraction {
+	// body is read once so every matcher and passthrough can read it
+	body, err := readRequestBody(r)
+	if err != nil {
+		return nil
+	}
+
+	for i, ri := range h.interactions {
+		// recorded URLs are absolute so incoming request is resolved
+		// against recorded host before matching
+		req := new(http.Request)
+		*req = *r
+		uri := *r.URL
+		uri.Scheme = ri.url.Scheme
+		uri.Host = ri.url.Host
+		req.URL = &uri
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if h.matcher(req, ri.interaction.Request) {
+			return &h.interactions[i]
+		}
+	}
+	return nil
+}
+
+func (h *ReplayHandler) serveUnmatched(w http.ResponseWriter, r *http.Request) {
+	err := fmt.Errorf("no recorded interaction matches %s %q", r.Method, r.URL)
+
+	if h.ad.Options.Verbose {
+		fmt.Println(err)
+	}
+
+	switch h.options.Unmatched {
+	case UnmatchedPassthrough:
+		h.upstream.ServeHTTP(w, r)
+	case UnmatchedFail:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		select {
+		case h.failures <- err:
+		default:
+		}
+	default:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
+
+// Serve starts mock server answering requests from recorded session
+// until it fails
+func (ad *APIDiff) Serve(addr string, handler *ReplayHandler) error {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	if ad.Options.Verbose {
+		fmt.Printf("Serving recorded session on %q...\n", addr)
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	case err := <-handler.Failures():
+		if closeErr := server.Close(); closeErr != nil {
+			return closeErr
+		}
+		return err
+	}
+}
@@ -0,0 +1,331 @@
+package apidiff
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dnaeon/go-vcr/cassette"
+	"github.com/tcnksm/go-httpstat"
+)
+
+// hopHeaders are not forwarded between client and backends
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	// compression is handled by the proxy transport so that bodies
+	// can be compared
+	"Accept-Encoding",
+}
+
+// ShadowOptions holds settings of shadow traffic proxy
+type ShadowOptions struct {
+	// Name of session where primary interactions are stored (optional)
+	Name      string
+	Primary   string
+	Candidate string
+	Rules     []MatchingRules
+}
+
+// ShadowProxy forwards requests to primary backend returning its response
+// to the client and mirrors them to candidate backend comparing both
+// responses asynchronously
+type ShadowProxy struct {
+	ad        *APIDiff
+	options   ShadowOptions
+	primary   *url.URL
+	candidate *url.URL
+	client    *http.Client
+	filter    cassette.Filter
+	redact    cassette.Filter
+
+	mu           sync.Mutex
+	wg           sync.WaitGroup
+	interactions []RecordedInteraction
+	results      map[int]Differences
+	// storage key of session version created by first stored request
+	key string
+	// occurrences of stored fingerprints so repeated requests are kept
+	occurrences map[string]int
+}
+
+// NewShadowProxy creates a reverse proxy for shadow traffic comparison
+func (ad *APIDiff) NewShadowProxy(options ShadowOptions) (*ShadowProxy, error) {
+	if !ad.isValidURL(options.Primary) {
+		return nil, fmt.Errorf("invalid primary backend URL %q", options.Primary)
+	}
+	if !ad.isValidURL(options.Candidate) {
+		return nil, fmt.Errorf("invalid candidate backend URL %q", options.Candidate)
+	}
+
+	primary, err := url.Parse(options.Primary)
+	if err != nil {
+		return nil, err
+	}
+	candidate, err := url.Parse(options.Candidate)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := compileRules(options.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ShadowProxy{
+		ad:        ad,
+		options:   options,
+		primary:   primary,
+		candidate: candidate,
+		client: &http.Client{
+			// redirects are returned to the client as they are
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		filter:      ad.createFilter(rules),
+		redact:      ad.createStorageFilter(rules),
+		results:     make(map[int]Differences),
+		occurrences: make(map[string]int),
+	}, nil
+}
+
+// shadowRequest is a copy of client request, the original one must not
+// be used once its handler returns
+type shadowRequest struct {
+	method string
+	url    url.URL
+	header http.Header
+	body   []byte
+}
+
+// ServeHTTP implements http.Handler interface
+func (p *ShadowProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sr := shadowRequest{
+		method: r.Method,
+		url:    *r.URL,
+		header: copyHeader(r.Header),
+		body:   body,
+	}
+
+	// mirror request to candidate while primary is serving the client
+	type mirror struct {
+		ci  *cassette.Interaction
+		err error
+	}
+	mirrored := make(chan mirror, 1)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		ci, _, err := p.forward(p.candidate, sr)
+		if err != nil && p.ad.Options.Verbose {
+			fmt.Printf("Unable to mirror %s %q due to %s\n", sr.method, sr.url.String(), err)
+		}
+		mirrored <- mirror{ci: ci, err: err}
+	}()
+
+	pi, stats, err := p.forward(p.primary, sr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	resp := pi.Response
+	for headerKey, headerValue := range resp.Headers {
+		if strings.EqualFold(headerKey, "Content-Length") {
+			continue
+		}
+		for _, childHeaderValue := range headerValue {
+			w.Header().Add(headerKey, childHeaderValue)
+		}
+	}
+	w.WriteHeader(resp.Code)
+	fmt.Fprint(w, resp.Body)
+
+	p.mu.Lock()
+	idx := len(p.interactions)
+	p.interactions = append(p.interactions, RecordedInteraction{
+		URL:        pi.Request.URL,
+		Method:     pi.Request.Method,
+		StatusCode: resp.Code,
+	})
+	p.mu.Unlock()
+
+	if p.options.Name != "" {
+		if err := p.store(pi, body, stats); err != nil && p.ad.Options.Verbose {
+			fmt.Printf("Unable to store %s %q due to %s\n", sr.method, sr.url.String(), err)
+		}
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		// unreachable candidate is a difference rather than a missing
+		// comparison
+		m := <-mirrored
+		if m.err != nil {
+			p.mu.Lock()
+			p.results[idx] = Differences{
+				InteractionIndex: idx,
+				URL:              pi.Request.URL,
+				Changed:          true,
+				Headers:          make(map[string]error),
+				Body:             map[string]error{"candidate": m.err},
+			}
+			p.mu.Unlock()
+			return
+		}
+
+		result, err := p.ad.compareInteractions(idx, p.options.Rules, *pi, *m.ci)
+		if err != nil {
+			if p.ad.Options.Verbose {
+				fmt.Printf("Unable to compare %s %q due to %s\n", sr.method, sr.url.String(), err)
+			}
+			return
+		}
+		result.URL = pi.Request.URL
+
+		p.mu.Lock()
+		p.results[idx] = result
+		p.mu.Unlock()
+	}()
+}
+
+// Wait blocks until all pending comparisons are finished
+func (p *ShadowProxy) Wait() {
+	p.wg.Wait()
+}
+
+// Report returns session of primary interactions and differences found
+// against candidate backend
+func (p *ShadowProxy) Report() (RecordedSession, map[int]Differences) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name := p.options.Name
+	if name == "" {
+		name = "shadow"
+	}
+
+	session := RecordedSession{
+		Name:         name,
+		Path:         p.ad.sessionPath(name),
+		Interactions: append([]RecordedInteraction{}, p.interactions...),
+	}
+
+	results := make(map[int]Differences, len(p.results))
+	for idx, result := range p.results {
+		results[idx] = result
+	}
+	return session, results
+}
+
+func (p *ShadowProxy) forward(base *url.URL, sr shadowRequest) (*cassette.Interaction, httpstat.Result, error) {
+	var stats httpstat.Result
+
+	uri := sr.url
+	uri.Scheme = base.Scheme
+	uri.Host = base.Host
+	uri.Path = path.Join("/", base.Path, sr.url.Path)
+
+	req, err := http.NewRequest(sr.method, uri.String(), bytes.NewReader(sr.body))
+	if err != nil {
+		return nil, stats, err
+	}
+	// each backend gets its own copy of headers
+	req.Header = copyHeader(sr.header)
+	for _, headerKey := range hopHeaders {
+		req.Header.Del(headerKey)
+	}
+
+	ctx := httpstat.WithHTTPStat(req.Context(), &stats)
+	req = req.WithContext(ctx)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, stats, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, stats, err
+	}
+	for _, headerKey := range hopHeaders {
+		resp.Header.Del(headerKey)
+	}
+
+	interaction := &cassette.Interaction{
+		Request: cassette.Request{
+			Body:    string(sr.body),
+			Headers: req.Header,
+			URL:     req.URL.String(),
+			Method:  req.Method,
+		},
+		Response: cassette.Response{
+			Body:    string(respBody),
+			Headers: resp.Header,
+			Status:  resp.Status,
+			Code:    resp.StatusCode,
+		},
+	}
+
+	if err = p.filter(interaction); err != nil {
+		return nil, stats, err
+	}
+	return interaction, stats, nil
+}
+
+func (p *ShadowProxy) store(interaction *cassette.Interaction, body []byte, stats httpstat.Result) error {
+	ri := RequestInteraction{
+		URL:     interaction.Request.URL,
+		Method:  interaction.Request.Method,
+		Payload: string(body),
+	}
+	result := newRequestStats(stats)
+
+	// client was already served so only stored copy is redacted
+	stored := copyInteraction(interaction)
+	if err := p.redact(stored); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.key == "" {
+		version, err := p.ad.NewVersion(p.options.Name)
+		if err != nil {
+			return err
+		}
+		p.key = versionKey(p.options.Name, version)
+	}
+
+	fingerprint := ri.Fingerprint()
+	p.occurrences[fingerprint]++
+	fingerprint = occurrenceFingerprint(fingerprint, p.occurrences[fingerprint])
+
+	return p.ad.Storage.SaveInteraction(p.key, fingerprint, &StoredInteraction{
+		Interactions: []*cassette.Interaction{stored},
+		Stats:        &result,
+		Recorded:     time.Now(),
+	})
+}
@@ -0,0 +1,555 @@
+package apidiff
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dnaeon/go-vcr/cassette"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	cassetteSuffix = ".yaml"
+	statsSuffix    = "_stats.yaml"
+	metadataFile   = ".session.yaml"
+)
+
+// Storage persists recorded sessions and their interactions. Session
+// versions are addressed as "name/vN" and are not listed as sessions
+type Storage interface {
+	// Sessions returns stored sessions without their interactions
+	Sessions() ([]RecordedSession, error)
+	// LoadMetadata returns session metadata or nil when there is none
+	LoadMetadata(session string) (*SessionMetadata, error)
+	// SaveMetadata stores session metadata
+	SaveMetadata(session string, metadata *SessionMetadata) error
+	// Interactions returns sorted fingerprints of session interactions
+	Interactions(session string) ([]string, error)
+	// LoadInteraction returns stored interaction of a session
+	LoadInteraction(session, fingerprint string) (*StoredInteraction, error)
+	// SaveInteraction stores interaction replacing an existing one
+	SaveInteraction(session, fingerprint string, interaction *StoredInteraction) error
+	// DeleteInteraction removes interaction from a session
+	DeleteInteraction(session, fingerprint string) error
+	// DeleteSession removes session with all its interactions and
+	// versions
+	DeleteSession(session string) error
+}
+
+// StoredInteraction holds recorded HTTP exchanges of an interaction
+type StoredInteraction struct {
+	// Interactions contains one exchange per followed redirect
+	Interactions []*cassette.Interaction
+	// Stats are missing for imported interactions
+	Stats    *RequestStats
+	Recorded time.Time
+}
+
+// Interaction returns first recorded HTTP exchange
+func (si *StoredInteraction) Interaction() *cassette.Interaction {
+	return si.Interactions[0]
+}
+
+// Final returns the last recorded HTTP exchange, it differs from the
+// first one when redirects were followed
+func (si *StoredInteraction) Final() *cassette.Interaction {
+	return si.Interactions[len(si.Interactions)-1]
+}
+
+// cassetteDocument mirrors go-vcr cassette file format
+type cassetteDocument struct {
+	Version      int                     `yaml:"version"`
+	Interactions []*cassette.Interaction `yaml:"interactions"`
+}
+
+func encodeCassette(interactions []*cassette.Interaction) ([]byte, error) {
+	data, err := yaml.Marshal(cassetteDocument{Version: 1, Interactions: interactions})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("---\n"), data...), nil
+}
+
+func decodeCassette(data []byte) ([]*cassette.Interaction, error) {
+	document := cassetteDocument{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	if len(document.Interactions) == 0 {
+		return nil, errors.New("cassette has no interactions")
+	}
+	return document.Interactions, nil
+}
+
+func decodeRequestStats(data []byte) (*RequestStats, error) {
+	stats := &RequestStats{}
+	if err := yaml.Unmarshal(data, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// validateStorageName rejects names that would escape storage root
+// or clash with metadata files
+func validateStorageName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	return nil
+}
+
+// validateSessionKey accepts session name optionally followed by
+// version as "name/vN"
+func validateSessionKey(session string) error {
+	parts := strings.Split(session, "/")
+	if len(parts) > 2 {
+		return fmt.Errorf("invalid session %q", session)
+	}
+	for _, part := range parts {
+		if err := validateStorageName(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeMetadata(metadata *SessionMetadata) ([]byte, error) {
+	return yaml.Marshal(metadata)
+}
+
+func decodeMetadata(data []byte) (*SessionMetadata, error) {
+	metadata := &SessionMetadata{}
+	if err := yaml.Unmarshal(data, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// FileStorage keeps every session as a directory with cassette and
+// stats YAML files named by interaction fingerprint
+type FileStorage struct {
+	Path string
+}
+
+// NewFileStorage creates storage rooted in a directory
+func NewFileStorage(path string) *FileStorage {
+	return &FileStorage{Path: path}
+}
+
+// Sessions implements Storage interface
+func (fs *FileStorage) Sessions() ([]RecordedSession, error) {
+	sessions := []RecordedSession{}
+
+	files, err := ioutil.ReadDir(fs.Path)
+	if err != nil {
+		return sessions, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			sessions = append(sessions, RecordedSession{
+				Name:    file.Name(),
+				Path:    filepath.Join(fs.Path, file.Name()),
+				Created: file.ModTime(),
+			})
+		}
+	}
+	return sessions, nil
+}
+
+// LoadMetadata implements Storage interface
+func (fs *FileStorage) LoadMetadata(session string) (*SessionMetadata, error) {
+	if err := validateStorageName(session); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(fs.Path, session, metadataFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeMetadata(data)
+}
+
+// SaveMetadata implements Storage interface
+func (fs *FileStorage) SaveMetadata(session string, metadata *SessionMetadata) error {
+	if err := validateStorageName(session); err != nil {
+		return err
+	}
+
+	data, err := encodeMetadata(metadata)
+	if err != nil {
+		return err
+	}
+
+	p := filepath.Join(fs.Path, session)
+	if err = os.MkdirAll(p, os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(p, metadataFile), data, 0644)
+}
+
+// Interactions implements Storage interface
+func (fs *FileStorage) Interactions(session string) ([]string, error) {
+	fingerprints := []string{}
+	if err := validateSessionKey(session); err != nil {
+		return fingerprints, err
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(fs.Path, session))
+	if err != nil {
+		return fingerprints, err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if !file.IsDir() && isCassetteFile(name) {
+			fingerprints = append(fingerprints, strings.TrimSuffix(name, cassetteSuffix))
+		}
+	}
+	return fingerprints, nil
+}
+
+// LoadInteraction implements Storage interface
+func (fs *FileStorage) LoadInteraction(session, fingerprint string) (*StoredInteraction, error) {
+	p, err := fs.interactionPath(session, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(p + cassetteSuffix)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(p + cassetteSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	interactions, err := decodeCassette(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load %q - %s", p+cassetteSuffix, err)
+	}
+
+	stored := &StoredInteraction{
+		Interactions: interactions,
+		Recorded:     info.ModTime(),
+	}
+
+	data, err = ioutil.ReadFile(p + statsSuffix)
+	if err == nil {
+		if stored.Stats, err = decodeRequestStats(data); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// SaveInteraction implements Storage interface
+func (fs *FileStorage) SaveInteraction(session, fingerprint string, interaction *StoredInteraction) error {
+	p, err := fs.interactionPath(session, fingerprint)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	data, err := encodeCassette(interaction.Interactions)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(p+cassetteSuffix, data, 0644); err != nil {
+		return err
+	}
+	if !interaction.Recorded.IsZero() {
+		if err = os.Chtimes(p+cassetteSuffix, interaction.Recorded, interaction.Recorded); err != nil {
+			return err
+		}
+	}
+
+	if interaction.Stats == nil {
+		if err = os.Remove(p + statsSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err = yaml.Marshal(interaction.Stats)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p+statsSuffix, data, 0600)
+}
+
+// DeleteInteraction implements Storage interface
+func (fs *FileStorage) DeleteInteraction(session, fingerprint string) error {
+	p, err := fs.interactionPath(session, fingerprint)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(p + cassetteSuffix); err != nil {
+		return err
+	}
+	if err = os.Remove(p + statsSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// DeleteSession implements Storage interface
+func (fs *FileStorage) DeleteSession(session string) error {
+	if err := validateSessionKey(session); err != nil {
+		return err
+	}
+
+	p := filepath.Join(fs.Path, session)
+	if _, err := os.Stat(p); err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (fs *FileStorage) interactionPath(session, fingerprint string) (string, error) {
+	if err := validateSessionKey(session); err != nil {
+		return "", err
+	}
+	if err := validateStorageName(fingerprint); err != nil {
+		return "", err
+	}
+	return filepath.Join(fs.Path, session, fingerprint), nil
+}
+
+// MemoryStorage keeps sessions in memory, it is safe for concurrent use
+type MemoryStorage struct {
+	mu       sync.RWMutex
+	sessions map[string]*memorySession
+}
+
+type memorySession struct {
+	created time.Time
+	files   map[string]memoryFile
+}
+
+type memoryFile struct {
+	data     []byte
+	modified time.Time
+}
+
+// NewMemoryStorage creates an empty in-memory storage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		sessions: make(map[string]*memorySession),
+	}
+}
+
+// Sessions implements Storage interface
+func (ms *MemoryStorage) Sessions() ([]RecordedSession, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	sessions := []RecordedSession{}
+	for name, session := range ms.sessions {
+		// versions are part of their session
+		if strings.Contains(name, "/") {
+			continue
+		}
+		sessions = append(sessions, RecordedSession{
+			Name:    name,
+			Created: session.created,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Name < sessions[j].Name
+	})
+	return sessions, nil
+}
+
+// LoadMetadata implements Storage interface
+func (ms *MemoryStorage) LoadMetadata(session string) (*SessionMetadata, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	s, found := ms.sessions[session]
+	if !found {
+		return nil, nil
+	}
+	file, found := s.files[metadataFile]
+	if !found {
+		return nil, nil
+	}
+	return decodeMetadata(file.data)
+}
+
+// SaveMetadata implements Storage interface
+func (ms *MemoryStorage) SaveMetadata(session string, metadata *SessionMetadata) error {
+	if err := validateStorageName(session); err != nil {
+		return err
+	}
+
+	data, err := encodeMetadata(metadata)
+	if err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.writeFile(session, metadataFile, data, time.Now())
+	return nil
+}
+
+// Interactions implements Storage interface
+func (ms *MemoryStorage) Interactions(session string) ([]string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	fingerprints := []string{}
+	s, found := ms.sessions[session]
+	if !found {
+		return fingerprints, fmt.Errorf("unable to find session %q", session)
+	}
+
+	for name := range s.files {
+		if isCassetteFile(name) {
+			fingerprints = append(fingerprints, strings.TrimSuffix(name, cassetteSuffix))
+		}
+	}
+	sort.Strings(fingerprints)
+	return fingerprints, nil
+}
+
+// LoadInteraction implements Storage interface
+func (ms *MemoryStorage) LoadInteraction(session, fingerprint string) (*StoredInteraction, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	s, found := ms.sessions[session]
+	if !found {
+		return nil, fmt.Errorf("unable to find session %q", session)
+	}
+	file, found := s.files[fingerprint+cassetteSuffix]
+	if !found {
+		return nil, fmt.Errorf("unable to find interaction %q", fingerprint)
+	}
+
+	interactions, err := decodeCassette(file.data)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := &StoredInteraction{
+		Interactions: interactions,
+		Recorded:     file.modified,
+	}
+	if stats, found := s.files[fingerprint+statsSuffix]; found {
+		if stored.Stats, err = decodeRequestStats(stats.data); err != nil {
+			return nil, err
+		}
+	}
+	return stored, nil
+}
+
+// SaveInteraction implements Storage interface
+func (ms *MemoryStorage) SaveInteraction(session, fingerprint string, interaction *StoredInteraction) error {
+	if err := validateSessionKey(session); err != nil {
+		return err
+	}
+	if err := validateStorageName(fingerprint); err != nil {
+		return err
+	}
+
+	data, err := encodeCassette(interaction.Interactions)
+	if err != nil {
+		return err
+	}
+
+	var stats []byte
+	if interaction.Stats != nil {
+		if stats, err = yaml.Marshal(interaction.Stats); err != nil {
+			return err
+		}
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	recorded := interaction.Recorded
+	if recorded.IsZero() {
+		recorded = time.Now()
+	}
+
+	ms.writeFile(session, fingerprint+cassetteSuffix, data, recorded)
+	if stats != nil {
+		ms.writeFile(session, fingerprint+statsSuffix, stats, recorded)
+	} else {
+		delete(ms.sessions[session].files, fingerprint+statsSuffix)
+	}
+	return nil
+}
+
+// DeleteInteraction implements Storage interface
+func (ms *MemoryStorage) DeleteInteraction(session, fingerprint string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	s, found := ms.sessions[session]
+	if !found {
+		return fmt.Errorf("unable to find session %q", session)
+	}
+	if _, found := s.files[fingerprint+cassetteSuffix]; !found {
+		return fmt.Errorf("unable to find interaction %q", fingerprint)
+	}
+
+	delete(s.files, fingerprint+cassetteSuffix)
+	delete(s.files, fingerprint+statsSuffix)
+	return nil
+}
+
+// DeleteSession implements Storage interface
+func (ms *MemoryStorage) DeleteSession(session string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, found := ms.sessions[session]; !found {
+		return fmt.Errorf("unable to find session %q", session)
+	}
+	for name := range ms.sessions {
+		if name == session || strings.HasPrefix(name, session+"/") {
+			delete(ms.sessions, name)
+		}
+	}
+	return nil
+}
+
+// writeFile stores raw session file, caller must hold write lock
+func (ms *MemoryStorage) writeFile(session, name string, data []byte, modified time.Time) {
+	s, found := ms.sessions[session]
+	if !found {
+		s = &memorySession{
+			created: modified,
+			files:   make(map[string]memoryFile),
+		}
+		ms.sessions[session] = s
+	}
+	s.files[name] = memoryFile{data: data, modified: modified}
+}
+
+// isCassetteFile reports whether stored file holds interaction cassette
+func isCassetteFile(name string) bool {
+	return strings.HasSuffix(name, cassetteSuffix) && !strings.HasSuffix(name, statsSuffix) && !strings.HasPrefix(name, ".")
+}
@@ -1,18 +1,19 @@
 package apidiff
 
 import (
-	"bytes"
-	"fmt"
-	"hash/fnv"
 	"net/http"
-	"sort"
 	"time"
+
+	"github.com/tcnksm/go-httpstat"
 )
 
 // Options holds shared CLI arguments from user
 type Options struct {
 	Verbose bool
 	Name    string
+	// Selection limits interactions that are recorded, compared, shown
+	// and served by their tags
+	Selection TagSelection
 }
 
 // RecordedSession represents stored API session
@@ -21,58 +22,64 @@ type RecordedSession struct {
 	Path         string
 	Interactions []RecordedInteraction
 	Created      time.Time
+	// Version of session recording, 0 for sessions recorded before
+	// versioning
+	Version int
+	// Legacy is set when interactions use unversioned fingerprints
+	Legacy bool
+	// Selection of tags session version was recorded with, nil when all
+	// manifest interactions were recorded
+	Selection *TagSelection
 }
 
 // RecordedInteraction represents recorded API interaction
 type RecordedInteraction struct {
-	URL        string
-	Method     string
-	StatusCode int
-	Stats      RequestStats
+	URL         string
+	Method      string
+	StatusCode  int
+	Stats       RequestStats
+	Fingerprint string
+	Tags        []string
 }
 
 // RequestInteraction represents request info for API interaction
 type RequestInteraction struct {
+	ID         string      `yaml:"id,omitempty"`
+	Name       string      `yaml:"name,omitempty"`
 	URL        string      `yaml:"url"`
 	Method     string      `yaml:"method"`
-	StatusCode int         `yaml:"status_code"`
-	Headers    http.Header `yaml:"headers"`
-	Payload    string      `yaml:"body"`
-}
-
-// Fingerprint returns unique signature of request that
-// is used for later comparison
-func (ri RequestInteraction) Fingerprint() string {
-	h := fnv.New32a()
-
-	var sortedHeaderKeys []string
-	for k := range ri.Headers {
-		sortedHeaderKeys = append(sortedHeaderKeys, k)
-	}
-	sort.Strings(sortedHeaderKeys)
-
-	var headers bytes.Buffer
-	for _, name := range sortedHeaderKeys {
-		for _, value := range ri.Headers[name] {
-			headers.WriteString(name)
-			headers.WriteString(value)
-		}
-	}
+	StatusCode int         `yaml:"status_code,omitempty"`
+	Headers    http.Header `yaml:"headers,omitempty"`
+	Payload    string      `yaml:"body,omitempty"`
+	// Query parameters are appended to URL
+	Query Values `yaml:"query,omitempty"`
+	// Form, Multipart and BodyFile replace body, files are read relative
+	// to manifest
+	Form      Values     `yaml:"form,omitempty"`
+	Multipart *Multipart `yaml:"multipart,omitempty"`
+	BodyFile  string     `yaml:"body_file,omitempty"`
+	// JSON document is deep merged into JSON of RequestInfo
+	JSON interface{} `yaml:"json,omitempty"`
+	Tags []string    `yaml:"tags,omitempty"`
+	// Redirects overrides redirect policy of manifest
+	Redirects *RedirectPolicy `yaml:"redirects,omitempty"`
+	// MatchingRules extend manifest rules, a rule of the same name
+	// overrides the manifest one
+	MatchingRules []MatchingRules `yaml:"matching_rules,omitempty"`
 
-	fingerprint := fmt.Sprintf(
-		"%s%s%d%s%s",
-		ri.URL,
-		ri.Method,
-		ri.StatusCode,
-		headers.String(),
-		ri.Payload,
-	)
+	// fingerprint composition inherited from manifest
+	fingerprint *FingerprintOptions
+	// manifest file and line interaction is defined at
+	origin string
+	line   int
+	// directory files of interaction are read relative to
+	dir string
+}
 
-	_, err := h.Write([]byte(fingerprint))
-	if err != nil {
-		panic(err)
-	}
-	return fmt.Sprint(h.Sum32())
+// Origin returns manifest file interaction was read from, empty when
+// manifest was not read from a file
+func (ri RequestInteraction) Origin() string {
+	return ri.origin
 }
 
 // RequestStats hold HTTP stats metrics
@@ -84,6 +91,16 @@ type RequestStats struct {
 	ContentTransfer  int `yaml:"content_transfer"`
 }
 
+func newRequestStats(result httpstat.Result) RequestStats {
+	return RequestStats{
+		DNSLookup:        int(result.DNSLookup / time.Millisecond),
+		TCPConnection:    int(result.TCPConnection / time.Millisecond),
+		TLSHandshake:     int(result.TLSHandshake / time.Millisecond),
+		ServerProcessing: int(result.ServerProcessing / time.Millisecond),
+		ContentTransfer:  int(result.ContentTransfer(time.Now()) / time.Millisecond),
+	}
+}
+
 // Duration returns total time spend on request
 func (rs RequestStats) Duration() int {
 	return rs.DNSLookup + rs.TCPConnection + rs.TLSHandshake + rs.ServerProcessing + rs.ContentTransfer
@@ -97,8 +114,16 @@ type MatchingRules struct {
 
 // RequestInfo contains shared API request details
 type RequestInfo struct {
-	Payload string      `yaml:"body"`
-	Headers http.Header `yaml:"headers"`
+	Payload string      `yaml:"body,omitempty"`
+	JSON    interface{} `yaml:"json,omitempty"`
+	Headers http.Header `yaml:"headers,omitempty"`
+
+	// authentication of manifest
+	auth *Auth
+	// cookies shared by interactions recorded in a single run
+	jar http.CookieJar
+	// redirect policy of manifest
+	redirects *RedirectPolicy
 }
 
 // Differences represents errors between two interactions
@@ -107,5 +132,8 @@ type Differences struct {
 	InteractionIndex int
 	Headers          map[string]error
 	Body             map[string]error
-	Changed          bool
+	// Redirects holds differences of redirect chains keyed by 1-based
+	// number of redirect
+	Redirects map[string]error
+	Changed   bool
 }
@@ -5,7 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/dnaeon/go-vcr/cassette"
 	"github.com/olekukonko/tablewriter"
@@ -47,6 +50,35 @@ func (ui *UI) ListSessions(sessions []RecordedSession, showCaption bool) {
 	fmt.Fprintln(ui.out)
 }
 
+// ShowHistory draws table of recorded session versions marking the
+// current baseline
+func (ui *UI) ShowHistory(versions []RecordedSession, current int) {
+	rows := [][]string{}
+	for _, version := range versions {
+		baseline := ""
+		if version.Version == current {
+			baseline = "*"
+		}
+		rows = append(rows, []string{
+			strconv.Itoa(version.Version),
+			version.Created.Format("2006-01-02 15:04:05"),
+			strconv.Itoa(len(version.Interactions)),
+			baseline,
+		})
+	}
+
+	fmt.Fprintln(ui.out)
+
+	table := tablewriter.NewWriter(ui.out)
+	table.SetCenterSeparator("|")
+	table.SetHeader([]string{"Version", "Created", "# Interactions", "Baseline"})
+	table.AppendBulk(rows)
+	table.SetCaption(true, fmt.Sprintf(" Total %d version(s)", len(rows)))
+	table.Render()
+
+	fmt.Fprintln(ui.out)
+}
+
 // ShowSession displays detail of selected session
 func (ui *UI) ShowSession(session RecordedSession) {
 	if len(session.Interactions) == 0 {
@@ -102,11 +134,13 @@ func (ui *UI) ShowInteractionDetail(interaction *cassette.Interaction, stats *Re
 		[]string{"Request", "URL", req.URL},
 		[]string{"Request", "Method", req.Method},
 		[]string{"Request", "Headers", fmt.Sprintf("%+v", req.Headers)},
+		[]string{"Request", "Cookies", ui.formatCookies((&http.Request{Header: req.Headers}).Cookies())},
 		[]string{"Request", "Params", fmt.Sprintf("%+v", req.Form)},
 		[]string{"Request", "Payload", ui.formatJSON(req.Body)},
 
 		// response
 		[]string{"Response", "Headers", fmt.Sprintf("%+v", resp.Headers)},
+		[]string{"Response", "Set Cookies", ui.formatCookies((&http.Response{Header: resp.Headers}).Cookies())},
 		[]string{"Response", "Status", resp.Status},
 		[]string{"Response", "Body", ui.formatJSON(resp.Body)},
 
@@ -142,6 +176,25 @@ func (ui *UI) ShowComparisonResults(source RecordedSession, errors map[int]Diffe
 				})
 				total++
 			}
+			var redirects []string
+			for redirect := range err.Redirects {
+				redirects = append(redirects, redirect)
+			}
+			// redirects are numbered so they are not sorted as strings
+			sort.Slice(redirects, func(i, j int) bool {
+				a, _ := strconv.Atoi(redirects[i])
+				b, _ := strconv.Atoi(redirects[j])
+				return a < b
+			})
+			for _, redirect := range redirects {
+				rows = append(rows, []string{
+					source.Name,
+					strconv.Itoa(i),
+					fmt.Sprintf("Redirect %s", redirect),
+					err.Redirects[redirect].Error(),
+				})
+				total++
+			}
 			for _, bodyValue := range err.Body {
 				rows = append(rows, []string{
 					source.Name,
@@ -168,6 +221,14 @@ func (ui *UI) ShowComparisonResults(source RecordedSession, errors map[int]Diffe
 	}
 }
 
+func (ui *UI) formatCookies(cookies []*http.Cookie) string {
+	values := make([]string, len(cookies))
+	for i, cookie := range cookies {
+		values[i] = cookie.String()
+	}
+	return strings.Join(values, "\n")
+}
+
 func (ui *UI) formatMS(duration int) string {
 	return fmt.Sprintf("%d ms", duration)
 }
@@ -0,0 +1,491 @@
+package apidiff
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SessionMetadata describes recorded versions of a session
+type SessionMetadata struct {
+	// Current is baseline version used when Pinned, otherwise latest
+	// version is the baseline
+	Current  int              `yaml:"current"`
+	Pinned   bool             `yaml:"pinned"`
+	Versions []SessionVersion `yaml:"versions"`
+}
+
+// SessionVersion describes single immutable recording of a session,
+// version 0 holds interactions recorded before versioning
+type SessionVersion struct {
+	Version int       `yaml:"version"`
+	Created time.Time `yaml:"created"`
+	// Selection of tags version was recorded with, nil when all manifest
+	// interactions were recorded
+	Selection *TagSelection `yaml:"selection,omitempty"`
+	// Tags of recorded interactions by their fingerprints
+	Tags map[string][]string `yaml:"tags,omitempty"`
+}
+
+// Latest returns highest recorded version or -1 when there is none
+func (sm *SessionMetadata) Latest() int {
+	latest := -1
+	for _, v := range sm.Versions {
+		if v.Version > latest {
+			latest = v.Version
+		}
+	}
+	return latest
+}
+
+// CurrentVersion returns version used as a baseline
+func (sm *SessionMetadata) CurrentVersion() int {
+	if sm.Pinned {
+		return sm.Current
+	}
+	return sm.Latest()
+}
+
+// Has reports whether version was recorded
+func (sm *SessionMetadata) Has(version int) bool {
+	for _, v := range sm.Versions {
+		if v.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// version returns recorded version, an empty one when it is missing
+func (sm *SessionMetadata) version(version int) *SessionVersion {
+	for i := range sm.Versions {
+		if sm.Versions[i].Version == version {
+			return &sm.Versions[i]
+		}
+	}
+	return &SessionVersion{Version: version}
+}
+
+// NewVersion starts a new immutable version of session that following
+// recordings are stored into
+func (ad *APIDiff) NewVersion(name string) (int, error) {
+	if err := validateStorageName(name); err != nil {
+		return 0, err
+	}
+
+	metadata, err := ad.metadata(name)
+	if err != nil {
+		return 0, err
+	}
+
+	version := metadata.Latest() + 1
+	if version == 0 {
+		version = 1
+	}
+	metadata.Versions = append(metadata.Versions, SessionVersion{
+		Version: version,
+		Created: time.Now(),
+	})
+
+	if err = ad.Storage.SaveMetadata(name, metadata); err != nil {
+		return 0, err
+	}
+
+	if ad.Options.Verbose {
+		fmt.Printf("Created version %d of session %q...\n", version, name)
+	}
+	return version, nil
+}
+
+// ShowVersion returns recorded session of given version
+func (ad *APIDiff) ShowVersion(name string, version int) (RecordedSession, error) {
+	sessions, err := ad.Storage.Sessions()
+	if err != nil {
+		return RecordedSession{}, err
+	}
+
+	for _, session := range sessions {
+		if session.Name != name {
+			continue
+		}
+
+		metadata, err := ad.metadata(name)
+		if err != nil {
+			return session, err
+		}
+		if !metadata.Has(version) {
+			return session, fmt.Errorf("Unable to find version %d of session %q", version, name)
+		}
+
+		session.Version = version
+		err = ad.loadInteractions(&session)
+		return session, err
+	}
+
+	return RecordedSession{}, fmt.Errorf("Unable to find session %q", name)
+}
+
+// History returns all recorded versions of session ordered from the
+// oldest together with current baseline version
+func (ad *APIDiff) History(name string) ([]RecordedSession, int, error) {
+	metadata, err := ad.metadata(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(metadata.Versions) == 0 {
+		return nil, 0, fmt.Errorf("Unable to find session %q", name)
+	}
+
+	var versions []RecordedSession
+	for _, v := range metadata.Versions {
+		session := RecordedSession{
+			Name:    name,
+			Path:    ad.sessionPath(name),
+			Created: v.Created,
+			Version: v.Version,
+		}
+		if err = ad.loadInteractions(&session); err != nil {
+			return nil, 0, err
+		}
+		versions = append(versions, session)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version < versions[j].Version
+	})
+	return versions, metadata.CurrentVersion(), nil
+}
+
+// Pin makes version a baseline of session instead of the latest one
+func (ad *APIDiff) Pin(name string, version int) error {
+	metadata, err := ad.metadata(name)
+	if err != nil {
+		return err
+	}
+	if !metadata.Has(version) {
+		return fmt.Errorf("Unable to find version %d of session %q", version, name)
+	}
+
+	metadata.Current = version
+	metadata.Pinned = true
+	return ad.Storage.SaveMetadata(name, metadata)
+}
+
+// Unpin makes the latest version a baseline of session
+func (ad *APIDiff) Unpin(name string) error {
+	metadata, err := ad.metadata(name)
+	if err != nil {
+		return err
+	}
+
+	metadata.Current = 0
+	metadata.Pinned = false
+	return ad.Storage.SaveMetadata(name, metadata)
+}
+
+// Prune removes old versions of session keeping the latest ones and
+// the pinned baseline, it returns removed versions
+func (ad *APIDiff) Prune(name string, keep int) ([]int, error) {
+	if keep < 1 {
+		return nil, errors.New("at least one version has to be kept")
+	}
+
+	metadata, err := ad.metadata(name)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := append([]SessionVersion(nil), metadata.Versions...)
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+
+	var pruned []int
+	var kept []SessionVersion
+	for i, v := range versions {
+		if i < keep || (metadata.Pinned && v.Version == metadata.Current) {
+			kept = append([]SessionVersion{v}, kept...)
+			continue
+		}
+
+		if err = ad.deleteVersion(name, v.Version); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, v.Version)
+
+		if ad.Options.Verbose {
+			fmt.Printf("Removed version %d of session %q...\n", v.Version, name)
+		}
+	}
+
+	metadata.Versions = kept
+	return pruned, ad.Storage.SaveMetadata(name, metadata)
+}
+
+// CompareVersions compares interactions of two recorded versions of
+// session matched by their fingerprints
+func (ad *APIDiff) CompareVersions(name string, source, target int, rules []MatchingRules) (map[int]Differences, error) {
+	results := make(map[int]Differences)
+
+	metadata, err := ad.metadata(name)
+	if err != nil {
+		return results, err
+	}
+	for _, version := range []int{source, target} {
+		if !metadata.Has(version) {
+			return results, fmt.Errorf("Unable to find version %d of session %q", version, name)
+		}
+	}
+
+	sourceKey := versionKey(name, source)
+	targetKey := versionKey(name, target)
+
+	fingerprints, err := ad.Storage.Interactions(sourceKey)
+	if err != nil {
+		return results, err
+	}
+
+	tags := metadata.version(source).Tags
+	for i, fingerprint := range fingerprints {
+		if !ad.Options.Selection.Match(tags[fingerprint]) {
+			continue
+		}
+
+		sc, err := ad.Storage.LoadInteraction(sourceKey, fingerprint)
+		if err != nil {
+			return results, err
+		}
+
+		tc, err := ad.Storage.LoadInteraction(targetKey, fingerprint)
+		if err != nil {
+			results[i] = Differences{
+				URL:              sc.Interaction().Request.URL,
+				InteractionIndex: i,
+				Headers:          map[string]error{},
+				Body: map[string]error{
+					"interaction": fmt.Errorf("missing in version %d", target),
+				},
+				Changed: true,
+			}
+			continue
+		}
+
+		result, err := ad.compareStored(i, rules, sc, tc)
+		if err != nil {
+			return results, err
+		}
+		result.URL = sc.Interaction().Request.URL
+		results[i] = result
+	}
+
+	return results, nil
+}
+
+// metadata returns session metadata, sessions recorded before
+// versioning get implicit version 0
+func (ad *APIDiff) metadata(name string) (*SessionMetadata, error) {
+	metadata, err := ad.Storage.LoadMetadata(name)
+	if err != nil {
+		return nil, err
+	}
+	if metadata != nil {
+		return metadata, nil
+	}
+
+	metadata = &SessionMetadata{}
+	fingerprints, err := ad.Storage.Interactions(name)
+	if err == nil && len(fingerprints) > 0 {
+		legacy := SessionVersion{Version: 0}
+		if stored, err := ad.Storage.LoadInteraction(name, fingerprints[0]); err == nil {
+			legacy.Created = stored.Recorded
+		}
+		metadata.Versions = append(metadata.Versions, legacy)
+	}
+	return metadata, nil
+}
+
+// currentKey returns storage key of session baseline version
+func (ad *APIDiff) currentKey(name string) (string, error) {
+	metadata, err := ad.metadata(name)
+	if err != nil {
+		return "", err
+	}
+	if len(metadata.Versions) == 0 {
+		return "", fmt.Errorf("Unable to find session %q", name)
+	}
+	return versionKey(name, metadata.CurrentVersion()), nil
+}
+
+// recordingKey returns storage key of latest session version creating
+// the first one for a new session
+func (ad *APIDiff) recordingKey(name string) (string, error) {
+	metadata, err := ad.metadata(name)
+	if err != nil {
+		return "", err
+	}
+
+	version := metadata.Latest()
+	if version < 0 {
+		if version, err = ad.NewVersion(name); err != nil {
+			return "", err
+		}
+	}
+	return versionKey(name, version), nil
+}
+
+func (ad *APIDiff) deleteVersion(name string, version int) error {
+	if version > 0 {
+		return ad.Storage.DeleteSession(versionKey(name, version))
+	}
+
+	// interactions recorded before versioning are stored in session
+	fingerprints, err := ad.Storage.Interactions(name)
+	if err != nil {
+		return err
+	}
+	for _, fingerprint := range fingerprints {
+		if err = ad.Storage.DeleteInteraction(name, fingerprint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promote stores a new version of session made of source version with
+// selected interactions replaced by ones recorded from target manifest
+// into session of target storage, pinned baseline moves to the new version.
+// Interactions paired by request matchers replace matched fingerprints.
+func (ad *APIDiff) promote(source RecordedSession, target Manifest, selected []int, targetStorage Storage, matched map[int]string) (int, error) {
+	metadata, err := ad.metadata(source.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := ad.NewVersion(source.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	sourceVersion := metadata.version(source.Version)
+	tags, err := ad.copyVersion(source, version, target, selected, targetStorage, matched, sourceVersion.Tags)
+	if err == nil {
+		err = ad.updateVersion(source.Name, version, func(v *SessionVersion) {
+			v.Selection = sourceVersion.Selection
+			v.Tags = tags
+		})
+	}
+	if err == nil && metadata.Pinned {
+		err = ad.Pin(source.Name, version)
+	}
+	if err != nil {
+		// do not leave partially stored version behind
+		_ = ad.discardVersion(source.Name, version)
+		return 0, err
+	}
+	return version, nil
+}
+
+// copyVersion copies source version into version replacing selected
+// interactions by ones recorded from target, it returns tags of copied
+// interactions
+func (ad *APIDiff) copyVersion(source RecordedSession, version int, target Manifest, selected []int, targetStorage Storage, matched map[int]string, sourceTags map[string][]string) (map[string][]string, error) {
+	sourceKey := versionKey(source.Name, source.Version)
+	key := versionKey(source.Name, version)
+	tags := make(map[string][]string)
+
+	// interactions paired by request matchers are stored under matched
+	// fingerprint so that they are paired again by next comparison
+	replaced := make(map[string]bool)
+	stored := make(map[int]string, len(selected))
+	for _, i := range selected {
+		fingerprint, found := matched[i]
+		if !found {
+			fingerprint = ad.storedFingerprint(sourceKey, target.Interactions[i])
+			stored[i] = target.Interactions[i].Fingerprint()
+		} else {
+			stored[i] = fingerprint
+		}
+		replaced[fingerprint] = true
+	}
+
+	fingerprints, err := ad.Storage.Interactions(sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, fingerprint := range fingerprints {
+		if replaced[fingerprint] {
+			continue
+		}
+
+		stored, err := ad.Storage.LoadInteraction(sourceKey, fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		if err = ad.Storage.SaveInteraction(key, fingerprint, stored); err != nil {
+			return nil, err
+		}
+		if len(sourceTags[fingerprint]) > 0 {
+			tags[fingerprint] = sourceTags[fingerprint]
+		}
+	}
+
+	for _, i := range selected {
+		interaction := target.Interactions[i]
+		fingerprint := stored[i]
+
+		recorded, err := targetStorage.LoadInteraction(source.Name, interaction.Fingerprint())
+		if err != nil {
+			return nil, err
+		}
+		if err = ad.Storage.SaveInteraction(key, fingerprint, recorded); err != nil {
+			return nil, err
+		}
+		if len(interaction.Tags) > 0 {
+			tags[fingerprint] = interaction.Tags
+		}
+	}
+	return tags, nil
+}
+
+// updateVersion changes stored metadata of session version
+func (ad *APIDiff) updateVersion(name string, version int, update func(*SessionVersion)) error {
+	metadata, err := ad.metadata(name)
+	if err != nil {
+		return err
+	}
+	if !metadata.Has(version) {
+		return fmt.Errorf("Unable to find version %d of session %q", version, name)
+	}
+
+	update(metadata.version(version))
+	return ad.Storage.SaveMetadata(name, metadata)
+}
+
+// discardVersion removes version together with its metadata entry
+func (ad *APIDiff) discardVersion(name string, version int) error {
+	metadata, err := ad.metadata(name)
+	if err != nil {
+		return err
+	}
+	if err = ad.deleteVersion(name, version); err != nil {
+		return err
+	}
+
+	var versions []SessionVersion
+	for _, v := range metadata.Versions {
+		if v.Version != version {
+			versions = append(versions, v)
+		}
+	}
+	metadata.Versions = versions
+	return ad.Storage.SaveMetadata(name, metadata)
+}
+
+// versionKey returns storage key of session version
+func versionKey(name string, version int) string {
+	if version == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s/v%d", name, version)
+}